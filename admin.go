@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const adminUsage = `usage: simple-subscribe admin <command> [flags] [email]
+
+commands:
+  list                  list subscribers (-status, -since, -json)
+  count                 count subscribers (-status, -since, -json)
+  show <email>          show one subscriber (-json)
+  history <email>       show the changes to one subscriber, oldest first (-json)
+  add <email>           add a confirmed subscriber, e.g. when migrating a list
+  remove <email>        remove a subscriber
+  clear-opt-out <email> let an address that opted out subscribe again
+  resend-confirmation <email>
+                        send a pending subscriber a new confirmation email`
+
+// Manage the subscriber list from the command line, writing results to w.
+func runAdmin(ctx context.Context, clients *ServiceClients, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(adminUsage)
+	}
+	cmd, args := args[0], args[1:]
+	flags := flag.NewFlagSet("admin "+cmd, flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "write JSON instead of a table")
+	status := flags.String("status", "all", "only include subscribers that are confirmed, pending, or all")
+	since := flags.String("since", "", "only include subscribers created on or after this date (YYYY-MM-DD)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "list", "count":
+		filter, err := newAdminFilter(*status, *since)
+		if err != nil {
+			return err
+		}
+		var subs []subscriber
+		err = filter.scan(ctx, clients.DynamoDB, func(sub subscriber) error {
+			subs = append(subs, sub)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if cmd == "count" {
+			if *asJSON {
+				return json.NewEncoder(w).Encode(map[string]int{"count": len(subs)})
+			}
+			_, err := fmt.Fprintln(w, len(subs))
+			return err
+		}
+		return writeSubscribers(w, subs, *asJSON)
+
+	case "show", "history", "add", "remove", "clear-opt-out", "resend-confirmation":
+		if flags.NArg() != 1 {
+			return fmt.Errorf("usage: simple-subscribe admin %s [flags] <email>", cmd)
+		}
+		email := flags.Arg(0)
+		// Commands that don't look up an item use the normalized address.
+		normalized, err := parseSubscriberEmail(email)
+		if err != nil {
+			normalized = email
+		}
+		switch cmd {
+		case "show":
+			sub, err := requireSubscriber(ctx, clients.DynamoDB, email)
+			if err != nil {
+				return err
+			}
+			return writeSubscribers(w, []subscriber{*sub}, *asJSON)
+		case "history":
+			return adminHistory(ctx, clients, normalized, *asJSON, w)
+		case "add":
+			return adminAdd(ctx, clients, email, w)
+		case "remove":
+			return adminRemove(ctx, clients, email, w)
+		case "clear-opt-out":
+			return adminClearOptOut(ctx, clients, normalized, w)
+		case "resend-confirmation":
+			return adminResend(ctx, clients, email, w)
+		}
+	}
+	return fmt.Errorf("unknown admin command: %s\n%s", cmd, adminUsage)
+}
+
+// adminFilter selects subscribers by status and when they were created.
+type adminFilter struct {
+	status string
+	since  time.Time
+}
+
+func newAdminFilter(status string, since string) (adminFilter, error) {
+	f := adminFilter{status: status}
+	switch status {
+	case "all", "confirmed", "pending":
+	default:
+		return f, fmt.Errorf("unknown status %q: use confirmed, pending, or all", status)
+	}
+	if since != "" {
+		t, err := time.ParseInLocation("2006-01-02", since, time.UTC)
+		if err != nil {
+			return f, fmt.Errorf("could not read -since date: %w", err)
+		}
+		f.since = t
+	}
+	return f, nil
+}
+
+// Call fn for each subscriber that matches the filter.
+func (f adminFilter) scan(ctx context.Context, svc DynamoDBAPI, fn func(subscriber) error) error {
+	match := func(sub subscriber) error {
+		if !f.since.IsZero() {
+			created, err := time.Parse(time.RFC3339, sub.CreatedAt)
+			if err != nil || created.Before(f.since) {
+				return nil
+			}
+		}
+		return fn(sub)
+	}
+	if f.status == "all" {
+		// Skip items that aren't subscribers, like feed state.
+		return scanSubscribers(ctx, svc, "attribute_exists(#C)", map[string]string{"#C": "confirm"}, nil, match)
+	}
+	return scanSubscribersByConfirm(ctx, svc, f.status == "confirmed", match)
+}
+
+// Write subscribers as a JSON array or as an aligned table.
+func writeSubscribers(w io.Writer, subs []subscriber, asJSON bool) error {
+	if asJSON {
+		if subs == nil {
+			subs = []subscriber{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(subs)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "EMAIL\tSTATUS\tCREATED\tCONFIRMED\tID")
+	for _, sub := range subs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", sub.Email, sub.status(), sub.CreatedAt, sub.ConfirmedAt, sub.ID)
+	}
+	return tw.Flush()
+}
+
+// Get a subscriber by their normalized address or, for items saved before
+// addresses were normalized, the address as given. Returns an error if there
+// is none.
+func requireSubscriber(ctx context.Context, svc DynamoDBAPI, email string) (*subscriber, error) {
+	keys := []string{email}
+	if normalized, err := parseSubscriberEmail(email); err == nil && normalized != email {
+		keys = []string{normalized, email}
+	}
+	for _, key := range keys {
+		sub, err := getSubscriber(ctx, svc, key)
+		if err != nil {
+			return nil, err
+		}
+		if sub != nil {
+			return sub, nil
+		}
+	}
+	return nil, fmt.Errorf("no subscriber with email %s", email)
+}
+
+// Write the changes to an address as a JSON array or as an aligned table.
+func adminHistory(ctx context.Context, clients *ServiceClients, email string, asJSON bool, w io.Writer) error {
+	if os.Getenv("HISTORY_TABLE_NAME") == "" {
+		return errors.New("history is only recorded when HISTORY_TABLE_NAME is set")
+	}
+	events, err := getHistory(ctx, clients.DynamoDB, email)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		if events == nil {
+			events = []historyEvent{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(events)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tACTION\tACTOR\tIP")
+	for _, e := range events {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.Time, e.Action, e.Actor, e.IP)
+	}
+	return tw.Flush()
+}
+
+// Add a subscriber who has already confirmed elsewhere, skipping double opt-in.
+func adminAdd(ctx context.Context, clients *ServiceClients, email string, w io.Writer) error {
+	addr, err := parseSubscriberEmail(email)
+	if err != nil {
+		return fmt.Errorf("could not add %s: %w", email, err)
+	}
+	existing, err := getSubscriber(ctx, clients.DynamoDB, addr)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.Confirm {
+		return fmt.Errorf("%s is already subscribed", addr)
+	}
+	optedOut, err := hasTombstone(ctx, clients.DynamoDB, addr)
+	if err != nil {
+		return err
+	}
+	if optedOut {
+		return fmt.Errorf("%s has opted out; if they have asked to rejoin, run clear-opt-out first", addr)
+	}
+	id := uuid.New().String()
+	if _, err := updateItemInDynamoDB(ctx, clients.DynamoDB, addr, id, clock(), true, nil, nil); err != nil {
+		return err
+	}
+	recordHistory(ctx, clients.DynamoDB, addr, historyAdded, historyActorAdmin, "")
+	_, err = fmt.Fprintf(w, "added %s\n", addr)
+	return err
+}
+
+// Remove a subscriber, whatever their status.
+func adminRemove(ctx context.Context, clients *ServiceClients, email string, w io.Writer) error {
+	sub, err := requireSubscriber(ctx, clients.DynamoDB, email)
+	if err != nil {
+		return err
+	}
+	if _, err := deleteEmailFromDynamoDb(ctx, clients.DynamoDB, sub.Email, sub.ID); err != nil {
+		return err
+	}
+	recordHistory(ctx, clients.DynamoDB, sub.Email, historyRemoved, historyActorAdmin, "")
+	_, err = fmt.Fprintf(w, "removed %s\n", sub.Email)
+	return err
+}
+
+// Remove an address's tombstone so it can be added or subscribe again.
+func adminClearOptOut(ctx context.Context, clients *ServiceClients, email string, w io.Writer) error {
+	optedOut, err := hasTombstone(ctx, clients.DynamoDB, email)
+	if err != nil {
+		return err
+	}
+	if !optedOut {
+		return fmt.Errorf("%s has not opted out", email)
+	}
+	if _, err := deleteTombstone(ctx, clients.DynamoDB, email); err != nil {
+		return err
+	}
+	recordHistory(ctx, clients.DynamoDB, email, historyOptOutCleared, historyActorAdmin, "")
+	_, err = fmt.Fprintf(w, "cleared opt-out for %s\n", email)
+	return err
+}
+
+// Send a pending subscriber their confirmation link again, and restart the
+// time they have to use it.
+func adminResend(ctx context.Context, clients *ServiceClients, email string, w io.Writer) error {
+	sub, err := requireSubscriber(ctx, clients.DynamoDB, email)
+	if err != nil {
+		return err
+	}
+	if sub.Confirm {
+		return fmt.Errorf("%s has already confirmed", sub.Email)
+	}
+	if _, err := updateItemInDynamoDB(ctx, clients.DynamoDB, sub.Email, sub.ID, clock(), false, nil, nil); err != nil {
+		return err
+	}
+	if _, err := sendEmailWithSES(ctx, clients.SES, sub.Email, sub.ID); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "sent confirmation email to %s\n", sub.Email)
+	return err
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRunAdmin(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+
+	allItems := &dynamodb.ScanOutput{
+		Items: []map[string]dynamodbtypes.AttributeValue{
+			subscriberItem("old@example.com", "1", true, "2023-12-31 23:59:59"),
+			subscriberItem("new@example.com", "2", false, "2024-02-01 10:00:00"),
+		},
+	}
+
+	tests := []struct {
+		name        string
+		args        []string
+		setupMocks  func(db *MockDynamoDBClient, mail *MockSESClient)
+		expectedOut string
+		expectedErr string
+	}{
+		{
+			name: "List as table",
+			args: []string{"list"},
+			setupMocks: func(db *MockDynamoDBClient, mail *MockSESClient) {
+				db.On("Scan", mock.Anything, mock.AnythingOfType("*dynamodb.ScanInput")).Return(allItems, nil).Once()
+			},
+			expectedOut: "EMAIL            STATUS     CREATED               CONFIRMED             ID\n" +
+				"old@example.com  confirmed  2023-12-31T23:59:59Z  2023-12-31T23:59:59Z  1\n" +
+				"new@example.com  pending    2024-02-01T10:00:00Z                        2\n",
+		},
+		{
+			name: "Count since date",
+			args: []string{"count", "-since", "2024-01-01"},
+			setupMocks: func(db *MockDynamoDBClient, mail *MockSESClient) {
+				db.On("Scan", mock.Anything, mock.AnythingOfType("*dynamodb.ScanInput")).Return(allItems, nil).Once()
+			},
+			expectedOut: "1\n",
+		},
+		{
+			name: "Count pending as JSON",
+			args: []string{"count", "-status", "pending", "-json"},
+			setupMocks: func(db *MockDynamoDBClient, mail *MockSESClient) {
+				db.On("Scan", mock.Anything, mock.MatchedBy(func(in *dynamodb.ScanInput) bool {
+					return in.FilterExpression != nil
+				})).Return(&dynamodb.ScanOutput{Items: allItems.Items[1:]}, nil).Once()
+			},
+			expectedOut: "{\"count\":1}\n",
+		},
+		{
+			name:        "Unknown status",
+			args:        []string{"list", "-status", "lapsed"},
+			setupMocks:  func(db *MockDynamoDBClient, mail *MockSESClient) {},
+			expectedErr: "unknown status",
+		},
+		{
+			name: "Show missing subscriber",
+			args: []string{"show", "missing@example.com"},
+			setupMocks: func(db *MockDynamoDBClient, mail *MockSESClient) {
+				db.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{}, nil).Once()
+			},
+			expectedErr: "no subscriber with email missing@example.com",
+		},
+		{
+			name: "Add new subscriber",
+			args: []string{"add", "new@example.com"},
+			setupMocks: func(db *MockDynamoDBClient, mail *MockSESClient) {
+				// No item and no tombstone.
+				db.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{}, nil).Twice()
+				db.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+					v := in.ExpressionAttributeValues[":confirmval"].(*dynamodbtypes.AttributeValueMemberBOOL)
+					return v.Value
+				})).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+			},
+			expectedOut: "added new@example.com\n",
+		},
+		{
+			name:        "Add invalid email",
+			args:        []string{"add", "not-an-email"},
+			setupMocks:  func(db *MockDynamoDBClient, mail *MockSESClient) {},
+			expectedErr: "could not add not-an-email",
+		},
+		{
+			name: "Remove subscriber",
+			args: []string{"remove", "old@example.com"},
+			setupMocks: func(db *MockDynamoDBClient, mail *MockSESClient) {
+				db.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{Item: allItems.Items[0]}, nil).Once()
+				db.On("TransactWriteItems", mock.Anything, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+					return tombstoneKeyFor("old@example.com")(in.TransactItems[1].Put.Item)
+				})).Return(&dynamodb.TransactWriteItemsOutput{}, nil).Once()
+			},
+			expectedOut: "removed old@example.com\n",
+		},
+		{
+			name: "Resend to pending subscriber",
+			args: []string{"resend-confirmation", "new@example.com"},
+			setupMocks: func(db *MockDynamoDBClient, mail *MockSESClient) {
+				db.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{Item: allItems.Items[1]}, nil).Once()
+				db.On("UpdateItem", mock.Anything, mock.AnythingOfType("*dynamodb.UpdateItemInput")).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+				mail.On("SendEmail", mock.Anything, mock.AnythingOfType("*ses.SendEmailInput")).Return(&ses.SendEmailOutput{}, nil).Once()
+			},
+			expectedOut: "sent confirmation email to new@example.com\n",
+		},
+		{
+			name: "Resend to confirmed subscriber",
+			args: []string{"resend-confirmation", "old@example.com"},
+			setupMocks: func(db *MockDynamoDBClient, mail *MockSESClient) {
+				db.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{Item: allItems.Items[0]}, nil).Once()
+			},
+			expectedErr: "old@example.com has already confirmed",
+		},
+		{
+			name:        "Unknown command",
+			args:        []string{"dance"},
+			setupMocks:  func(db *MockDynamoDBClient, mail *MockSESClient) {},
+			expectedErr: "unknown admin command: dance",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDynamoDB := new(MockDynamoDBClient)
+			mockSES := new(MockSESClient)
+			tt.setupMocks(mockDynamoDB, mockSES)
+
+			var out bytes.Buffer
+			err := runAdmin(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB, SES: mockSES}, tt.args, &out)
+
+			if tt.expectedErr != "" {
+				assert.ErrorContains(t, err, tt.expectedErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expectedOut, out.String())
+			}
+			mockDynamoDB.AssertExpectations(t)
+			mockSES.AssertExpectations(t)
+		})
+	}
+}
+
+func TestRunAdminShowJSON(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+
+	mockDynamoDB := new(MockDynamoDBClient)
+	mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{
+		Item: subscriberItem("test@example.com", "123", true, "2024-01-01 00:00:00"),
+	}, nil).Once()
+
+	var out bytes.Buffer
+	err := runAdmin(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB}, []string{"show", "-json", "test@example.com"}, &out)
+
+	assert.NoError(t, err)
+	var subs []subscriber
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &subs))
+	assert.Equal(t, []subscriber{{Email: "test@example.com", ID: "123", Confirm: true,
+		CreatedAt: "2024-01-01T00:00:00Z", ConfirmedAt: "2024-01-01T00:00:00Z", UpdatedAt: "2024-01-01T00:00:00Z"}}, subs)
+}
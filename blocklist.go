@@ -0,0 +1,84 @@
+package main
+
+import (
+	_ "embed"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The lists shipped with Simple Subscribe. Refresh the disposable domains with
+// `make blocklists`.
+var (
+	//go:embed blocklists/disposable_domains.txt
+	embeddedDisposableDomains string
+	//go:embed blocklists/role_accounts.txt
+	embeddedRoleAccounts string
+)
+
+// Reasons a signup is blocked, used as the Reason metric label.
+const (
+	blockedDisposable = "disposable"
+	blockedRole       = "role"
+)
+
+var (
+	disposableDomainsOnce sync.Once
+	disposableDomains     map[string]bool
+	roleAccountsOnce      sync.Once
+	roleAccounts          map[string]bool
+)
+
+// Parse a list with one entry per line, ignoring blank lines and # comments.
+func parseBlocklist(list string) map[string]bool {
+	entries := map[string]bool{}
+	for _, line := range strings.Split(list, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		if line = strings.ToLower(strings.TrimSpace(line)); line != "" {
+			entries[line] = true
+		}
+	}
+	return entries
+}
+
+// Report whether a normalized address should be silently dropped from the
+// subscribe flow, and why. With BLOCK_DISPOSABLE_DOMAINS set, addresses at the
+// embedded disposable domains, those in DISPOSABLE_DOMAINS, or their
+// subdomains are blocked. With BLOCK_ROLE_ACCOUNTS set, addresses with a local
+// part in the embedded list or ROLE_ACCOUNTS are blocked.
+func blockedSignup(email string) (string, bool) {
+	at := strings.LastIndex(email, "@")
+	local, domain := email[:at], email[at+1:]
+
+	if block, _ := strconv.ParseBool(os.Getenv("BLOCK_DISPOSABLE_DOMAINS")); block {
+		disposableDomainsOnce.Do(func() { disposableDomains = parseBlocklist(embeddedDisposableDomains) })
+		for d := domain; ; {
+			if disposableDomains[d] {
+				return blockedDisposable, true
+			}
+			_, parent, ok := strings.Cut(d, ".")
+			if !ok {
+				break
+			}
+			d = parent
+		}
+		if domainListMatches(os.Getenv("DISPOSABLE_DOMAINS"), domain) {
+			return blockedDisposable, true
+		}
+	}
+
+	if block, _ := strconv.ParseBool(os.Getenv("BLOCK_ROLE_ACCOUNTS")); block {
+		roleAccountsOnce.Do(func() { roleAccounts = parseBlocklist(embeddedRoleAccounts) })
+		local, _, _ = strings.Cut(local, "+")
+		if roleAccounts[local] {
+			return blockedRole, true
+		}
+		for _, entry := range strings.Split(os.Getenv("ROLE_ACCOUNTS"), ",") {
+			if strings.ToLower(strings.TrimSpace(entry)) == local {
+				return blockedRole, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	list := parseBlocklist("# comment\nMailinator.com\n\n  yopmail.com  # inline\n")
+
+	assert.Equal(t, map[string]bool{"mailinator.com": true, "yopmail.com": true}, list)
+}
+
+func TestEmbeddedBlocklists(t *testing.T) {
+	assert.True(t, parseBlocklist(embeddedDisposableDomains)["mailinator.com"])
+	assert.True(t, parseBlocklist(embeddedRoleAccounts)["postmaster"])
+}
+
+func TestBlockedSignup(t *testing.T) {
+	tests := []struct {
+		name           string
+		email          string
+		env            map[string]string
+		expectedReason string
+	}{
+		{name: "Off by default", email: "ford@mailinator.com"},
+		{
+			name:           "Disposable domain",
+			email:          "ford@mailinator.com",
+			env:            map[string]string{"BLOCK_DISPOSABLE_DOMAINS": "true"},
+			expectedReason: blockedDisposable,
+		},
+		{
+			name:           "Disposable subdomain",
+			email:          "ford@eu.mailinator.com",
+			env:            map[string]string{"BLOCK_DISPOSABLE_DOMAINS": "true"},
+			expectedReason: blockedDisposable,
+		},
+		{
+			name:  "Lookalike domain",
+			email: "ford@notmailinator.com",
+			env:   map[string]string{"BLOCK_DISPOSABLE_DOMAINS": "true"},
+		},
+		{
+			name:           "Custom disposable domain",
+			email:          "ford@throwaway.example",
+			env:            map[string]string{"BLOCK_DISPOSABLE_DOMAINS": "true", "DISPOSABLE_DOMAINS": "other.example, Throwaway.example"},
+			expectedReason: blockedDisposable,
+		},
+		{
+			name:  "Custom disposable domain without blocking",
+			email: "ford@throwaway.example",
+			env:   map[string]string{"DISPOSABLE_DOMAINS": "throwaway.example"},
+		},
+		{
+			name:           "Role account",
+			email:          "postmaster@example.com",
+			env:            map[string]string{"BLOCK_ROLE_ACCOUNTS": "true"},
+			expectedReason: blockedRole,
+		},
+		{
+			name:           "Role account with tag",
+			email:          "abuse+reports@example.com",
+			env:            map[string]string{"BLOCK_ROLE_ACCOUNTS": "true"},
+			expectedReason: blockedRole,
+		},
+		{
+			name:           "Custom role account",
+			email:          "press@example.com",
+			env:            map[string]string{"BLOCK_ROLE_ACCOUNTS": "true", "ROLE_ACCOUNTS": "Press,media"},
+			expectedReason: blockedRole,
+		},
+		{
+			name:  "Person",
+			email: "ford@example.com",
+			env:   map[string]string{"BLOCK_DISPOSABLE_DOMAINS": "true", "BLOCK_ROLE_ACCOUNTS": "true"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+
+			reason, blocked := blockedSignup(tt.email)
+
+			assert.Equal(t, tt.expectedReason != "", blocked)
+			assert.Equal(t, tt.expectedReason, reason)
+		})
+	}
+}
+
+func TestSubscribeIgnoresBlockedAddress(t *testing.T) {
+	os.Setenv("BASE_URL", "https://example.com")
+	os.Setenv("CONFIRM_SUBSCRIBE_PAGE", "/confirm-subscribe")
+	os.Setenv("SUBSCRIBE_PATH", "subscribe")
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	os.Setenv("BLOCK_DISPOSABLE_DOMAINS", "true")
+	defer os.Unsetenv("BLOCK_DISPOSABLE_DOMAINS")
+
+	mockDynamoDB := new(MockDynamoDBClient)
+	mockSES := new(MockSESClient)
+
+	resp, err := lambdaHandler(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB, SES: mockSES}, events.APIGatewayV2HTTPRequest{
+		RawPath:               "/subscribe/",
+		QueryStringParameters: map[string]string{"email": "ford@yopmail.com"},
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/confirm-subscribe", resp.Headers["Location"])
+	// Nothing is read or written and no email is sent.
+	mockDynamoDB.AssertExpectations(t)
+	mockSES.AssertExpectations(t)
+}
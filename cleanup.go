@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// cleanupConfig controls removal of subscription requests that were never confirmed.
+type cleanupConfig struct {
+	// Pending items last updated longer ago than this are deleted.
+	MaxAge time.Duration
+	// Pause between delete batches to leave write capacity for subscribers.
+	BatchPause time.Duration
+	// Count what would be deleted without deleting anything.
+	DryRun bool
+}
+
+// cleanupResult reports what a cleanup run found and did.
+type cleanupResult struct {
+	Scanned int
+	Stale   int
+	Deleted int
+	Skipped int
+	// Stale items that changed, e.g. were confirmed, after the scan, and so
+	// were kept.
+	Changed int
+}
+
+// Read cleanup settings from CLEANUP_MAX_AGE (default 168h), CLEANUP_BATCH_PAUSE
+// (default 1s), and CLEANUP_DRY_RUN.
+func cleanupConfigFromEnv() cleanupConfig {
+	cfg := cleanupConfig{
+		MaxAge:     7 * 24 * time.Hour,
+		BatchPause: time.Second,
+	}
+	if d, err := time.ParseDuration(os.Getenv("CLEANUP_MAX_AGE")); err == nil && d > 0 {
+		cfg.MaxAge = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("CLEANUP_BATCH_PAUSE")); err == nil && d >= 0 {
+		cfg.BatchPause = d
+	}
+	cfg.DryRun, _ = strconv.ParseBool(os.Getenv("CLEANUP_DRY_RUN"))
+	return cfg
+}
+
+// Delete pending (confirm == false) items last updated longer ago than
+// cfg.MaxAge, scanning the table a page at a time.
+func cleanupPendingSubscriptions(ctx context.Context, svc DynamoDBAPI, cfg cleanupConfig, now time.Time) (cleanupResult, error) {
+	log := loggerFrom(ctx)
+	cutoff := now.Add(-cfg.MaxAge)
+	var result cleanupResult
+
+	paginator := dynamodb.NewScanPaginator(svc, &dynamodb.ScanInput{
+		TableName:        aws.String(os.Getenv("DB_TABLE_NAME")),
+		FilterExpression: aws.String("#C = :false"),
+		// Only fetch what is needed to decide and to delete.
+		ProjectionExpression: aws.String("email, #U, #T"),
+		ExpressionAttributeNames: map[string]string{
+			"#C": "confirm",
+			"#U": "updated_at",
+			"#T": "timestamp",
+		},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":false": &dynamodbtypes.AttributeValueMemberBOOL{Value: false},
+		},
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Error("could not scan table", "error", err)
+			return result, err
+		}
+		result.Scanned += int(page.ScannedCount)
+
+		var stale []map[string]dynamodbtypes.AttributeValue
+		for _, item := range page.Items {
+			email, _ := item["email"].(*dynamodbtypes.AttributeValueMemberS)
+			var sub subscriber
+			if err := attributevalue.UnmarshalMap(item, &sub); err != nil || email == nil {
+				result.Skipped++
+				continue
+			}
+			sub.fillLegacyTimes()
+			// A pending item's updated_at is set each time a confirmation email is
+			// sent, whether for a new request or a resend.
+			requested, err := time.Parse(time.RFC3339, sub.UpdatedAt)
+			if err != nil {
+				log.Warn("skipping item with unreadable timestamp", logKeyEmail, email.Value, "error", err)
+				result.Skipped++
+				continue
+			}
+			if requested.After(cutoff) {
+				continue
+			}
+			stale = append(stale, item)
+		}
+		result.Stale += len(stale)
+		if cfg.DryRun {
+			continue
+		}
+
+		for i, item := range stale {
+			// Pause after each batch's worth of deletes.
+			if i > 0 && i%maxBatchWriteItems == 0 {
+				select {
+				case <-time.After(cfg.BatchPause):
+				case <-ctx.Done():
+					return result, ctx.Err()
+				}
+			}
+			deleted, err := deleteStaleItem(ctx, svc, item)
+			if err != nil {
+				return result, err
+			}
+			if deleted {
+				result.Deleted++
+			} else {
+				result.Changed++
+			}
+		}
+	}
+
+	log.Info("cleaned up pending subscriptions",
+		"scanned", result.Scanned,
+		"stale", result.Stale,
+		"deleted", result.Deleted,
+		"skipped", result.Skipped,
+		"changed", result.Changed,
+		"dry_run", cfg.DryRun,
+	)
+	return result, nil
+}
+
+// Delete a stale pending item as it was scanned. If it has been confirmed or
+// updated since, it is kept. Reports whether it was deleted.
+func deleteStaleItem(ctx context.Context, svc DynamoDBAPI, item map[string]dynamodbtypes.AttributeValue) (bool, error) {
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(os.Getenv("DB_TABLE_NAME")),
+		Key:       map[string]dynamodbtypes.AttributeValue{"email": item["email"]},
+		ExpressionAttributeNames: map[string]string{
+			"#C": "confirm",
+			"#U": "updated_at",
+		},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":false": &dynamodbtypes.AttributeValueMemberBOOL{Value: false},
+		},
+	}
+	if updated, ok := item["updated_at"]; ok {
+		input.ExpressionAttributeValues[":seen"] = updated
+		input.ConditionExpression = aws.String("#C = :false AND #U = :seen")
+	} else {
+		// Items that haven't been migrated only have the legacy timestamp.
+		input.ExpressionAttributeNames["#T"] = "timestamp"
+		input.ExpressionAttributeValues[":seen"] = item["timestamp"]
+		input.ConditionExpression = aws.String("#C = :false AND attribute_not_exists(#U) AND #T = :seen")
+	}
+
+	ctx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "DynamoDB", "DeleteItem")
+	defer span.End()
+	defer observeBackend("DeleteItem", time.Now())
+	_, err := svc.DeleteItem(ctx, input)
+	var changed *dynamodbtypes.ConditionalCheckFailedException
+	if errors.As(err, &changed) {
+		return false, nil
+	}
+	if err != nil {
+		recordSpanError(span, err)
+		loggerFrom(ctx).Error("could not delete stale item", "error", err)
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func pendingItem(email string, timestamp string) map[string]dynamodbtypes.AttributeValue {
+	return map[string]dynamodbtypes.AttributeValue{
+		"email":     &dynamodbtypes.AttributeValueMemberS{Value: email},
+		"timestamp": &dynamodbtypes.AttributeValueMemberS{Value: timestamp},
+	}
+}
+
+func TestCleanupConfigFromEnv(t *testing.T) {
+	os.Setenv("CLEANUP_MAX_AGE", "48h")
+	os.Setenv("CLEANUP_BATCH_PAUSE", "0s")
+	os.Setenv("CLEANUP_DRY_RUN", "true")
+	defer os.Unsetenv("CLEANUP_MAX_AGE")
+	defer os.Unsetenv("CLEANUP_BATCH_PAUSE")
+	defer os.Unsetenv("CLEANUP_DRY_RUN")
+
+	assert.Equal(t, cleanupConfig{MaxAge: 48 * time.Hour, BatchPause: 0, DryRun: true}, cleanupConfigFromEnv())
+}
+
+func TestCleanupPendingSubscriptions(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	lastKey := map[string]dynamodbtypes.AttributeValue{"email": &dynamodbtypes.AttributeValueMemberS{Value: "old1@example.com"}}
+
+	setupScan := func(mockSvc *MockDynamoDBClient) {
+		mockSvc.On("Scan", mock.Anything, mock.MatchedBy(func(in *dynamodb.ScanInput) bool {
+			return in.ExclusiveStartKey == nil
+		})).Return(&dynamodb.ScanOutput{
+			Items: []map[string]dynamodbtypes.AttributeValue{
+				pendingItem("old1@example.com", "2024-06-01 00:00:00"),
+				pendingItem("new@example.com", "2024-06-09 00:00:00"),
+			},
+			ScannedCount:     3,
+			LastEvaluatedKey: lastKey,
+		}, nil).Once()
+		mockSvc.On("Scan", mock.Anything, mock.MatchedBy(func(in *dynamodb.ScanInput) bool {
+			return in.ExclusiveStartKey != nil
+		})).Return(&dynamodb.ScanOutput{
+			Items: []map[string]dynamodbtypes.AttributeValue{
+				pendingItem("old2@example.com", "2024-05-01 08:00:00"),
+				pendingItem("bad@example.com", "yesterday"),
+			},
+			ScannedCount: 2,
+		}, nil).Once()
+	}
+
+	t.Run("Deletes stale items", func(t *testing.T) {
+		mockSvc := new(MockDynamoDBClient)
+		setupScan(mockSvc)
+		mockSvc.On("DeleteItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.DeleteItemInput) bool {
+			return *in.ConditionExpression == "#C = :false AND attribute_not_exists(#U) AND #T = :seen" &&
+				in.ExpressionAttributeValues[":seen"].(*dynamodbtypes.AttributeValueMemberS).Value != ""
+		})).Return(&dynamodb.DeleteItemOutput{}, nil).Twice()
+
+		result, err := cleanupPendingSubscriptions(context.Background(), mockSvc, cleanupConfig{MaxAge: 7 * 24 * time.Hour}, now)
+
+		assert.NoError(t, err)
+		assert.Equal(t, cleanupResult{Scanned: 5, Stale: 2, Deleted: 2, Skipped: 1}, result)
+		mockSvc.AssertExpectations(t)
+	})
+
+	t.Run("Keeps items that changed after the scan", func(t *testing.T) {
+		mockSvc := new(MockDynamoDBClient)
+		mockSvc.On("Scan", mock.Anything, mock.Anything).Return(&dynamodb.ScanOutput{
+			Items: []map[string]dynamodbtypes.AttributeValue{
+				{
+					"email":      &dynamodbtypes.AttributeValueMemberS{Value: "old@example.com"},
+					"updated_at": &dynamodbtypes.AttributeValueMemberS{Value: "2024-06-01T00:00:00Z"},
+				},
+			},
+			ScannedCount: 1,
+		}, nil).Once()
+		// The subscriber confirmed between the scan and the delete.
+		mockSvc.On("DeleteItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.DeleteItemInput) bool {
+			return *in.ConditionExpression == "#C = :false AND #U = :seen" &&
+				in.ExpressionAttributeValues[":seen"].(*dynamodbtypes.AttributeValueMemberS).Value == "2024-06-01T00:00:00Z"
+		})).Return(&dynamodb.DeleteItemOutput{}, &dynamodbtypes.ConditionalCheckFailedException{Message: aws.String("changed")}).Once()
+
+		result, err := cleanupPendingSubscriptions(context.Background(), mockSvc, cleanupConfig{MaxAge: 7 * 24 * time.Hour}, now)
+
+		assert.NoError(t, err)
+		assert.Equal(t, cleanupResult{Scanned: 1, Stale: 1, Changed: 1}, result)
+		mockSvc.AssertExpectations(t)
+	})
+
+	t.Run("Dry run deletes nothing", func(t *testing.T) {
+		mockSvc := new(MockDynamoDBClient)
+		setupScan(mockSvc)
+
+		result, err := cleanupPendingSubscriptions(context.Background(), mockSvc, cleanupConfig{MaxAge: 7 * 24 * time.Hour, DryRun: true}, now)
+
+		assert.NoError(t, err)
+		assert.Equal(t, cleanupResult{Scanned: 5, Stale: 2, Deleted: 0, Skipped: 1}, result)
+		mockSvc.AssertNotCalled(t, "DeleteItem", mock.Anything, mock.Anything)
+		mockSvc.AssertExpectations(t)
+	})
+
+	t.Run("Scan error", func(t *testing.T) {
+		mockSvc := new(MockDynamoDBClient)
+		mockSvc.On("Scan", mock.Anything, mock.Anything).Return(&dynamodb.ScanOutput{}, errors.New("scan error")).Once()
+
+		_, err := cleanupPendingSubscriptions(context.Background(), mockSvc, cleanupConfig{MaxAge: time.Hour}, now)
+
+		assert.ErrorContains(t, err, "scan error")
+		mockSvc.AssertExpectations(t)
+	})
+}
+
+func TestBatchWriteItemsRetriesUnprocessed(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	requests := []dynamodbtypes.WriteRequest{
+		{DeleteRequest: &dynamodbtypes.DeleteRequest{Key: pendingItem("a@example.com", "")}},
+		{DeleteRequest: &dynamodbtypes.DeleteRequest{Key: pendingItem("b@example.com", "")}},
+	}
+
+	mockSvc := new(MockDynamoDBClient)
+	mockSvc.On("BatchWriteItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.BatchWriteItemInput) bool {
+		return len(in.RequestItems["TestTable"]) == 2
+	})).Return(&dynamodb.BatchWriteItemOutput{
+		UnprocessedItems: map[string][]dynamodbtypes.WriteRequest{"TestTable": requests[1:]},
+	}, nil).Once()
+	mockSvc.On("BatchWriteItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.BatchWriteItemInput) bool {
+		return len(in.RequestItems["TestTable"]) == 1
+	})).Return(&dynamodb.BatchWriteItemOutput{}, nil).Once()
+
+	assert.NoError(t, batchWriteItems(context.Background(), mockSvc, requests))
+	mockSvc.AssertExpectations(t)
+}
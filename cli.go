@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// Run a command given on the command line instead of starting the Lambda handler.
+func runCommand(ctx context.Context, clients *ServiceClients, name string, args []string) error {
+	switch name {
+	case "serve":
+		metrics = newMetrics(envOrDefault("METRICS_BACKEND", "prometheus"))
+		return runServer(clients, args)
+	case "admin":
+		return runAdmin(ctx, clients, args, os.Stdout)
+	case "export":
+		return runExport(ctx, clients, args, os.Stdout)
+	case "import":
+		return runImport(ctx, clients, args, os.Stdout)
+	case "send":
+		return runSend(ctx, clients, args, os.Stdout)
+	case "feed":
+		return runFeed(ctx, clients, args, os.Stdout)
+	case "migrate-timestamps":
+		return runMigrateTimestamps(ctx, clients, args, os.Stdout)
+	case "migrate-emails":
+		return runMigrateEmails(ctx, clients, args, os.Stdout)
+	}
+	return fmt.Errorf("unknown command: %s", name)
+}
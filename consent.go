@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// consentRecord is evidence of a subscriber's consent, taken from the request
+// in which they gave it.
+type consentRecord struct {
+	IP        string `dynamodbav:"ip" json:"ip"`
+	UserAgent string `dynamodbav:"user_agent" json:"user_agent"`
+	// When consent was given, in RFC 3339 format and UTC.
+	Time string `dynamodbav:"time" json:"time"`
+	// The page the request came from, from its Referer header.
+	Page string `dynamodbav:"page" json:"page"`
+	// The version of the consent text shown, from CONSENT_VERSION.
+	Version string `dynamodbav:"version" json:"version"`
+}
+
+// Record the consent evidence in a subscribe or verify request.
+func consentFromEvent(event events.APIGatewayV2HTTPRequest, now time.Time) *consentRecord {
+	return &consentRecord{
+		IP:        event.RequestContext.HTTP.SourceIP,
+		UserAgent: event.RequestContext.HTTP.UserAgent,
+		Time:      now.UTC().Format(time.RFC3339),
+		// API Gateway gives header names in lowercase.
+		Page:    event.Headers["referer"],
+		Version: os.Getenv("CONSENT_VERSION"),
+	}
+}
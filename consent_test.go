@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestConsentFromEvent(t *testing.T) {
+	os.Setenv("CONSENT_VERSION", "2024-06")
+	defer os.Unsetenv("CONSENT_VERSION")
+
+	event := events.APIGatewayV2HTTPRequest{
+		Headers: map[string]string{"referer": "https://example.com/newsletter"},
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+				SourceIP:  "192.0.2.1",
+				UserAgent: "Mozilla/5.0",
+			},
+		},
+	}
+	now := time.Date(2024, 6, 1, 14, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+
+	assert.Equal(t, &consentRecord{
+		IP:        "192.0.2.1",
+		UserAgent: "Mozilla/5.0",
+		Time:      "2024-06-01T12:00:00Z",
+		Page:      "https://example.com/newsletter",
+		Version:   "2024-06",
+	}, consentFromEvent(event, now))
+}
+
+func TestUpdateItemInDynamoDBRecordsConsent(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	consent := &consentRecord{IP: "192.0.2.1", Time: "2024-06-01T12:00:00Z"}
+
+	tests := []struct {
+		name          string
+		confirm       bool
+		wantAttribute string
+		wantSet       string
+	}{
+		{name: "Subscribe", confirm: false, wantAttribute: "subscribe_consent", wantSet: "#CR = :consentval"},
+		// Only the first confirmation's evidence is kept.
+		{name: "Verify", confirm: true, wantAttribute: "verify_consent", wantSet: "#CR = if_not_exists(#CR, :consentval)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockSvc := new(MockDynamoDBClient)
+			mockSvc.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+				record, ok := in.ExpressionAttributeValues[":consentval"].(*dynamodbtypes.AttributeValueMemberM)
+				return ok && in.ExpressionAttributeNames["#CR"] == tt.wantAttribute &&
+					strings.Contains(*in.UpdateExpression, tt.wantSet) &&
+					record.Value["ip"].(*dynamodbtypes.AttributeValueMemberS).Value == "192.0.2.1"
+			})).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+
+			_, err := updateItemInDynamoDB(context.Background(), mockSvc, "test@example.com", "123", time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC), tt.confirm, nil, consent)
+
+			assert.NoError(t, err)
+			mockSvc.AssertExpectations(t)
+		})
+	}
+}
+
+func TestRepeatConfirmChangesNothing(t *testing.T) {
+	os.Setenv("BASE_URL", "https://example.com")
+	os.Setenv("SUCCESS_PAGE", "/success")
+	os.Setenv("VERIFY_PATH", "verify")
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	os.Setenv("HISTORY_TABLE_NAME", "History")
+	defer os.Unsetenv("HISTORY_TABLE_NAME")
+	os.Setenv("TOMBSTONE_SALT", "pepper")
+	defer os.Unsetenv("TOMBSTONE_SALT")
+
+	confirmed := subscriberItem("a@example.com", "1", true, "2024-06-01 11:00:00")
+	mockDynamoDB := new(MockDynamoDBClient)
+	mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{Item: confirmed}, nil).Once()
+	mockDynamoDB.On("UpdateItem", mock.Anything, mock.AnythingOfType("*dynamodb.UpdateItemInput")).Return(&dynamodb.UpdateItemOutput{Attributes: confirmed}, nil).Once()
+	// The legacy timestamp fix-up is the only other write.
+	mockDynamoDB.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+		return in.ConditionExpression != nil && *in.ConditionExpression == "#T = :legacy"
+	})).Return(&dynamodb.UpdateItemOutput{}, nil).Maybe()
+
+	resp, err := lambdaHandler(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB}, events.APIGatewayV2HTTPRequest{
+		RawPath:               "/verify/",
+		QueryStringParameters: map[string]string{"email": "a@example.com", "id": "1"},
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/success", resp.Headers["Location"])
+	// No history, no cleared opt-out, and no webhook.
+	mockDynamoDB.AssertNotCalled(t, "PutItem", mock.Anything, mock.Anything)
+	mockDynamoDB.AssertNotCalled(t, "DeleteItem", mock.Anything, mock.Anything)
+	mockDynamoDB.AssertExpectations(t)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+)
+
+// Write everything stored for an email as indented JSON, including attributes
+// the subscriber type doesn't know about and the address's history.
+func subscriberDataJSON(ctx context.Context, svc DynamoDBAPI, email string) ([]byte, error) {
+	item, err := getSubscriberItem(ctx, svc, email)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, errors.New("no item for email")
+	}
+	var data map[string]any
+	if err := attributevalue.UnmarshalMap(item, &data); err != nil {
+		return nil, err
+	}
+	history, err := getHistory(ctx, svc, email)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) > 0 {
+		data["history"] = history
+	}
+	return json.MarshalIndent(data, "", "  ")
+}
+
+// Email a subscriber a copy of everything stored for their address.
+func sendSubscriberData(ctx context.Context, clients *ServiceClients, email string) error {
+	data, err := subscriberDataJSON(ctx, clients.DynamoDB, email)
+	if err != nil {
+		return err
+	}
+	loggerFrom(ctx).Debug("sending subscriber data", logKeyEmail, email)
+
+	// HTML format
+	msg := fmt.Sprintf("<p>Hello! You're receiving this email because you asked for a copy of the data stored about you on my list.</p><p>Here is everything stored for your email address:</p><pre>%s</pre><p>If you did not request this email, you can safely ignore it.</p>", html.EscapeString(string(data)))
+
+	// Plain text format
+	txt := fmt.Sprintf("Hello! You're receiving this email because you asked for a copy of the data stored about you on my list.\n\nHere is everything stored for your email address:\n\n%s\n\nIf you did not request this email, you can safely ignore it.", data)
+
+	_, err = sendMessageWithSES(ctx, clients.SES, email, "Your data on my list", msg, txt)
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSubscriberDataJSON(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+
+	item := subscriberItem("a@example.com", "1", true, "2024-01-01 00:00:00")
+	item["verify_consent"] = &dynamodbtypes.AttributeValueMemberM{Value: map[string]dynamodbtypes.AttributeValue{
+		"ip": &dynamodbtypes.AttributeValueMemberS{Value: "192.0.2.1"},
+	}}
+	item["unknown"] = &dynamodbtypes.AttributeValueMemberN{Value: "42"}
+	mockSvc := new(MockDynamoDBClient)
+	mockSvc.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{Item: item}, nil).Once()
+
+	data, err := subscriberDataJSON(context.Background(), mockSvc, "a@example.com")
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"email": "a@example.com",
+		"id": "1",
+		"confirm": true,
+		"timestamp": "2024-01-01 00:00:00",
+		"verify_consent": {"ip": "192.0.2.1"},
+		"unknown": 42
+	}`, string(data))
+	mockSvc.AssertExpectations(t)
+}
+
+func TestDataRequest(t *testing.T) {
+	os.Setenv("BASE_URL", "https://example.com")
+	os.Setenv("ERROR_PAGE", "/error")
+	os.Setenv("SUCCESS_PAGE", "/success")
+	os.Setenv("DATA_REQUEST_PATH", "my-data")
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	defer os.Unsetenv("DATA_REQUEST_PATH")
+
+	tests := []struct {
+		name             string
+		query            map[string]string
+		expectGet        bool
+		expectSend       bool
+		expectedLocation string
+	}{
+		{
+			name:             "Matching email and id",
+			query:            map[string]string{"email": "a@example.com", "id": "1"},
+			expectGet:        true,
+			expectSend:       true,
+			expectedLocation: "https://example.com/success",
+		},
+		{
+			name:             "Wrong id",
+			query:            map[string]string{"email": "a@example.com", "id": "2"},
+			expectGet:        true,
+			expectedLocation: "https://example.com/error",
+		},
+		{
+			name:             "Missing id",
+			query:            map[string]string{"email": "a@example.com"},
+			expectedLocation: "https://example.com/error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDynamoDB := new(MockDynamoDBClient)
+			mockSES := new(MockSESClient)
+			if tt.expectGet {
+				mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{
+					Item: subscriberItem("a@example.com", "1", true, "2024-01-01 00:00:00"),
+				}, nil)
+			}
+			if tt.expectSend {
+				mockSES.On("SendEmail", mock.Anything, mock.MatchedBy(func(in *ses.SendEmailInput) bool {
+					return in.Destination.ToAddresses[0] == "a@example.com" &&
+						strings.Contains(*in.Message.Body.Text.Data, `"id": "1"`) &&
+						strings.Contains(*in.Message.Body.Html.Data, `&#34;email&#34;: &#34;a@example.com&#34;`)
+				})).Return(&ses.SendEmailOutput{}, nil).Once()
+			}
+
+			resp, err := lambdaHandler(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB, SES: mockSES}, events.APIGatewayV2HTTPRequest{
+				RawPath:               "/my-data/",
+				QueryStringParameters: tt.query,
+			})
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedLocation, resp.Headers["Location"])
+			mockDynamoDB.AssertExpectations(t)
+			mockSES.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Resolver looks up the DNS records that show a domain takes mail.
+// *net.Resolver satisfies it; tests use a fake.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Default limit on the DNS lookups for one domain check, and how long a result
+// is remembered.
+const (
+	defaultDNSTimeout  = 2 * time.Second
+	defaultDNSCacheTTL = time.Hour
+	maxDomainChecks    = 1000
+)
+
+// Report whether the subscribe endpoint checks that an address's domain takes
+// mail, which needs CHECK_EMAIL_DOMAIN set.
+func domainCheckEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("CHECK_EMAIL_DOMAIN"))
+	return enabled
+}
+
+type domainCheckResult struct {
+	deliverable bool
+	expires     time.Time
+}
+
+// domainChecks caches results by domain for DNS_CACHE_TTL, so a warm Lambda
+// doesn't repeat lookups for popular domains. It holds at most
+// maxDomainChecks results.
+var domainChecks = struct {
+	sync.Mutex
+	results map[string]domainCheckResult
+}{results: map[string]domainCheckResult{}}
+
+// Report whether a domain can receive mail: it has MX records, or, with none,
+// A or AAAA records to fall back to. A null MX (RFC 7505) means it takes no
+// mail. Lookups that fail for any reason other than the records not existing
+// return an error and aren't cached, so a DNS outage doesn't turn subscribers
+// away.
+func domainDeliverable(ctx context.Context, r Resolver, domain string) (bool, error) {
+	now := clock()
+	domainChecks.Lock()
+	cached, ok := domainChecks.results[domain]
+	domainChecks.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.deliverable, nil
+	}
+
+	ctx, cancel := withTimeout(ctx, "DNS_TIMEOUT", defaultDNSTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "DNS", "Lookup")
+	defer span.End()
+	defer observeBackend("DNSLookup", time.Now())
+
+	deliverable, err := lookupDeliverable(ctx, r, domain)
+	if err != nil {
+		recordSpanError(span, err)
+		return false, err
+	}
+
+	ttl := defaultDNSCacheTTL
+	if d, err := time.ParseDuration(os.Getenv("DNS_CACHE_TTL")); err == nil && d > 0 {
+		ttl = d
+	}
+	cacheDomainCheck(domain, domainCheckResult{deliverable: deliverable, expires: now.Add(ttl)}, now)
+	return deliverable, nil
+}
+
+// Remember a result. When the cache is full, expired results are dropped
+// first, then whichever others it takes to make room.
+func cacheDomainCheck(domain string, result domainCheckResult, now time.Time) {
+	domainChecks.Lock()
+	defer domainChecks.Unlock()
+	if _, ok := domainChecks.results[domain]; !ok && len(domainChecks.results) >= maxDomainChecks {
+		for d, r := range domainChecks.results {
+			if !now.Before(r.expires) {
+				delete(domainChecks.results, d)
+			}
+		}
+		for d := range domainChecks.results {
+			if len(domainChecks.results) < maxDomainChecks {
+				break
+			}
+			delete(domainChecks.results, d)
+		}
+	}
+	domainChecks.results[domain] = result
+}
+
+func lookupDeliverable(ctx context.Context, r Resolver, domain string) (bool, error) {
+	// A trailing dot stops the resolver trying the domain under search domains.
+	mxs, err := r.LookupMX(ctx, domain+".")
+	if err != nil && !dnsNotFound(err) {
+		return false, err
+	}
+	if len(mxs) > 0 {
+		return !(len(mxs) == 1 && mxs[0].Host == "."), nil
+	}
+
+	hosts, err := r.LookupHost(ctx, domain+".")
+	if err != nil && !dnsNotFound(err) {
+		return false, err
+	}
+	return len(hosts) > 0, nil
+}
+
+// Report whether a lookup failed because the records don't exist.
+func dnsNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// Common mail domains, for suggesting a fix when an address's domain is a
+// near miss.
+var commonMailDomains = []string{
+	"aol.com",
+	"gmail.com",
+	"googlemail.com",
+	"hotmail.co.uk",
+	"hotmail.com",
+	"icloud.com",
+	"live.com",
+	"mail.com",
+	"me.com",
+	"msn.com",
+	"outlook.com",
+	"proton.me",
+	"protonmail.com",
+	"yahoo.co.uk",
+	"yahoo.com",
+}
+
+// Suggest the address with its domain corrected to a common mail domain it's
+// within two typos of, or return "" if there's none.
+func suggestEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	local, domain := email[:at], email[at+1:]
+	best, bestDistance := "", 3
+	for _, common := range commonMailDomains {
+		if common == domain {
+			return ""
+		}
+		if d := editDistance(domain, common); d < bestDistance {
+			best, bestDistance = common, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return local + "@" + best
+}
+
+// Count the insertions, deletions, substitutions, and swaps of adjacent
+// characters that turn a into b.
+func editDistance(a string, b string) int {
+	// Rows for the previous two prefixes of a and the current one.
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+// Return the resolver for domain checks: the one set on c, or the system's.
+func (c *ServiceClients) resolver() Resolver {
+	if c.Resolver != nil {
+		return c.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// Report whether a request asks for a JSON reply rather than a redirect.
+func acceptsJSON(event events.APIGatewayV2HTTPRequest) bool {
+	return strings.Contains(event.Headers["accept"], "application/json")
+}
+
+// undeliverableResponse is the JSON reply to a subscribe request for an address
+// at a domain that takes no mail.
+type undeliverableResponse struct {
+	Error      string `json:"error"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+// Build the JSON reply for an address at a domain that takes no mail,
+// suggesting a corrected address if EMAIL_SUGGESTIONS is set.
+func undeliverableJSON(email string) string {
+	body := undeliverableResponse{Error: "undeliverable_domain"}
+	if suggest, _ := strconv.ParseBool(os.Getenv("EMAIL_SUGGESTIONS")); suggest {
+		body.Suggestion = suggestEmail(email)
+	}
+	b, _ := json.Marshal(body)
+	return string(b)
+}
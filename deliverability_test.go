@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeResolver answers from fixed records and counts lookups. Domains it
+// doesn't know are not found.
+type fakeResolver struct {
+	mx      map[string][]*net.MX
+	hosts   map[string][]string
+	err     error
+	lookups int
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	r.lookups++
+	if r.err != nil {
+		return nil, r.err
+	}
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.lookups++
+	if hosts, ok := r.hosts[host]; ok {
+		return hosts, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// Forget cached domain checks.
+func resetDomainChecks() {
+	domainChecks.Lock()
+	domainChecks.results = map[string]domainCheckResult{}
+	domainChecks.Unlock()
+}
+
+func TestDomainDeliverable(t *testing.T) {
+	r := &fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com.": {{Host: "mx.example.com.", Pref: 10}},
+			"nomail.com.":  {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{"a-only.com.": {"192.0.2.1"}},
+	}
+
+	tests := []struct {
+		domain   string
+		expected bool
+	}{
+		{domain: "example.com", expected: true},
+		{domain: "a-only.com", expected: true},
+		{domain: "nomail.com", expected: false},
+		{domain: "gmial.com", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			resetDomainChecks()
+
+			got, err := domainDeliverable(context.Background(), r, tt.domain)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestDomainDeliverableCache(t *testing.T) {
+	resetDomainChecks()
+	defer func(c func() time.Time) { clock = c }(clock)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+	r := &fakeResolver{mx: map[string][]*net.MX{"example.com.": {{Host: "mx.example.com.", Pref: 10}}}}
+
+	domainDeliverable(context.Background(), r, "example.com")
+	domainDeliverable(context.Background(), r, "example.com")
+	assert.Equal(t, 1, r.lookups)
+
+	// Results expire after DNS_CACHE_TTL.
+	now = now.Add(2 * time.Hour)
+	domainDeliverable(context.Background(), r, "example.com")
+	assert.Equal(t, 2, r.lookups)
+}
+
+func TestDomainDeliverableLookupFailure(t *testing.T) {
+	resetDomainChecks()
+	r := &fakeResolver{err: errors.New("server misbehaving")}
+
+	_, err := domainDeliverable(context.Background(), r, "example.com")
+	assert.Error(t, err)
+
+	// Failures aren't cached.
+	domainDeliverable(context.Background(), r, "example.com")
+	assert.Equal(t, 2, r.lookups)
+}
+
+func TestDomainCheckCacheIsBounded(t *testing.T) {
+	resetDomainChecks()
+	defer resetDomainChecks()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	cacheDomainCheck("old.example", domainCheckResult{expires: now.Add(-time.Minute)}, now)
+	for i := 1; i < maxDomainChecks; i++ {
+		cacheDomainCheck(strconv.Itoa(i)+".example", domainCheckResult{expires: now.Add(time.Hour)}, now)
+	}
+	assert.Len(t, domainChecks.results, maxDomainChecks)
+
+	// Expired results make room first.
+	cacheDomainCheck("new.example", domainCheckResult{expires: now.Add(time.Hour)}, now)
+	assert.Len(t, domainChecks.results, maxDomainChecks)
+	assert.NotContains(t, domainChecks.results, "old.example")
+	assert.Contains(t, domainChecks.results, "new.example")
+
+	// With none expired, another result takes the place of an older one.
+	cacheDomainCheck("newer.example", domainCheckResult{expires: now.Add(time.Hour)}, now)
+	assert.Len(t, domainChecks.results, maxDomainChecks)
+	assert.Contains(t, domainChecks.results, "newer.example")
+}
+
+func TestSuggestEmail(t *testing.T) {
+	tests := []struct {
+		email    string
+		expected string
+	}{
+		{email: "ford@gmial.com", expected: "ford@gmail.com"},
+		{email: "ford@hotmial.com", expected: "ford@hotmail.com"},
+		{email: "ford@yaho.com", expected: "ford@yahoo.com"},
+		{email: "ford@outlok.co", expected: "ford@outlook.com"},
+		{email: "ford@gmail.com", expected: ""},
+		{email: "ford@example.com", expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			assert.Equal(t, tt.expected, suggestEmail(tt.email))
+		})
+	}
+}
+
+func TestSubscribeChecksDomain(t *testing.T) {
+	os.Setenv("BASE_URL", "https://example.com")
+	os.Setenv("ERROR_PAGE", "/error")
+	os.Setenv("SUBSCRIBE_PATH", "subscribe")
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	os.Setenv("CHECK_EMAIL_DOMAIN", "true")
+	defer os.Unsetenv("CHECK_EMAIL_DOMAIN")
+
+	tests := []struct {
+		name             string
+		headers          map[string]string
+		suggest          bool
+		expectedStatus   int
+		expectedLocation string
+		expectedBody     string
+	}{
+		{
+			name:             "Redirect",
+			expectedStatus:   303,
+			expectedLocation: "https://example.com/error",
+		},
+		{
+			name:           "JSON",
+			headers:        map[string]string{"accept": "application/json"},
+			expectedStatus: 422,
+			expectedBody:   `{"error":"undeliverable_domain"}`,
+		},
+		{
+			name:           "JSON with suggestion",
+			headers:        map[string]string{"accept": "application/json"},
+			suggest:        true,
+			expectedStatus: 422,
+			expectedBody:   `{"error":"undeliverable_domain","suggestion":"ford@gmail.com"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetDomainChecks()
+			if tt.suggest {
+				os.Setenv("EMAIL_SUGGESTIONS", "true")
+				defer os.Unsetenv("EMAIL_SUGGESTIONS")
+			}
+
+			// Nothing is written and no email is sent.
+			mockDynamoDB := new(MockDynamoDBClient)
+			mockSES := new(MockSESClient)
+
+			resp, err := lambdaHandler(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB, SES: mockSES, Resolver: &fakeResolver{}}, events.APIGatewayV2HTTPRequest{
+				RawPath:               "/subscribe/",
+				QueryStringParameters: map[string]string{"email": "ford@gmial.com"},
+				Headers:               tt.headers,
+			})
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode)
+			assert.Equal(t, tt.expectedLocation, resp.Headers["Location"])
+			assert.Equal(t, tt.expectedBody, resp.Body)
+			mockDynamoDB.AssertExpectations(t)
+			mockSES.AssertExpectations(t)
+		})
+	}
+}
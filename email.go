@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Limits from RFC 5321, in octets. A whole address can be at most 254 so that
+// it fits in a 256-octet path with its angle brackets.
+const (
+	maxLocalPartLength   = 64
+	maxEmailLength       = 254
+	maxDomainLabelLength = 63
+)
+
+// Return the address in raw if raw is nothing but an address: no display
+// name, comment, angle brackets, or group. Quoted local parts are only
+// accepted with ALLOW_QUOTED_LOCAL_PART set, and stay quoted only if they
+// need to be.
+func bareAddress(raw string, addr *mail.Address) (string, error) {
+	bare := strings.Trim((&mail.Address{Address: addr.Address}).String(), "<>")
+	if addr.Name != "" || (raw != bare && raw != quoteLocalPart(addr.Address)) {
+		return "", errors.New("must be a bare address, without a name or comment")
+	}
+	if strings.HasPrefix(raw, `"`) || strings.HasPrefix(bare, `"`) {
+		if allow, _ := strconv.ParseBool(os.Getenv("ALLOW_QUOTED_LOCAL_PART")); !allow {
+			return "", errors.New("quoted local parts are not accepted")
+		}
+	}
+	if strings.HasSuffix(bare, "]") {
+		return "", errors.New("IP address domains are not accepted")
+	}
+	return bare, nil
+}
+
+// Quote the local part of an address, escaping quotes and backslashes.
+func quoteLocalPart(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(addr[:at]) + `"` + addr[at:]
+}
+
+// Check a normalized address against the RFC 5321 length limits, require a
+// domain name made of letters, digits, and hyphens, and apply
+// EMAIL_DOMAIN_DENYLIST and EMAIL_DOMAIN_ALLOWLIST.
+func checkEmail(email string) error {
+	at := strings.LastIndex(email, "@")
+	local, domain := email[:at], email[at+1:]
+	if len(local) > maxLocalPartLength {
+		return fmt.Errorf("local part is longer than %d characters", maxLocalPartLength)
+	}
+	if len(email) > maxEmailLength {
+		return fmt.Errorf("address is longer than %d characters", maxEmailLength)
+	}
+
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return errors.New("domain must have more than one label")
+	}
+	for _, label := range labels {
+		if !validDomainLabel(label) {
+			return fmt.Errorf("invalid domain label %q", label)
+		}
+	}
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return errors.New("IP address domains are not accepted")
+	}
+
+	if domainListMatches(os.Getenv("EMAIL_DOMAIN_DENYLIST"), domain) {
+		return errors.New("domain is not accepted")
+	}
+	if allow := os.Getenv("EMAIL_DOMAIN_ALLOWLIST"); allow != "" && !domainListMatches(allow, domain) {
+		return errors.New("domain is not accepted")
+	}
+	return nil
+}
+
+// Report whether label is 1 to 63 letters, digits, and hyphens, neither
+// starting nor ending with a hyphen.
+func validDomainLabel(label string) bool {
+	if label == "" || len(label) > maxDomainLabelLength || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Report whether domain is, or is under, one of the domains in a
+// comma-separated list.
+func domainListMatches(list string, domain string) bool {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(entry)), ".")
+		if entry == "" {
+			continue
+		}
+		if ascii, err := idna.Lookup.ToASCII(entry); err == nil {
+			entry = ascii
+		}
+		if domain == entry || strings.HasSuffix(domain, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// Domains whose mailboxes ignore dots and +tags in the local part.
+var gmailDomains = map[string]bool{"gmail.com": true, "googlemail.com": true}
+
+// Normalize a bare address so the same mailbox always has the same key. The
+// address is lowercased and an internationalized domain is converted to its
+// ASCII (punycode) form. With NORMALIZE_GMAIL set, Gmail addresses also lose
+// their dots and +tags.
+func normalizeEmail(addr string) (string, error) {
+	at := strings.LastIndex(addr, "@")
+	if at < 1 || at == len(addr)-1 {
+		return "", errors.New("missing local part or domain")
+	}
+	local := strings.ToLower(addr[:at])
+	domain, err := idna.Lookup.ToASCII(strings.TrimSuffix(addr[at+1:], "."))
+	if err != nil {
+		return "", fmt.Errorf("invalid domain: %w", err)
+	}
+
+	if fold, _ := strconv.ParseBool(os.Getenv("NORMALIZE_GMAIL")); fold && gmailDomains[domain] {
+		local, _, _ = strings.Cut(local, "+")
+		local = strings.ReplaceAll(local, ".", "")
+		domain = "gmail.com"
+		if local == "" {
+			return "", errors.New("missing local part")
+		}
+	}
+	return local + "@" + domain, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		name      string
+		addr      string
+		foldGmail bool
+		expected  string
+		wantErr   bool
+	}{
+		{name: "Lowercase", addr: "Ford.Prefect@Example.COM", expected: "ford.prefect@example.com"},
+		{name: "Trailing dot on domain", addr: "ford@example.com.", expected: "ford@example.com"},
+		{name: "Internationalized domain", addr: "ford@Bücher.example", expected: "ford@xn--bcher-kva.example"},
+		{name: "Quoted local part", addr: "\"Ford Prefect\"@example.com", expected: "\"ford prefect\"@example.com"},
+		{name: "Gmail left alone by default", addr: "Ford.Prefect+news@gmail.com", expected: "ford.prefect+news@gmail.com"},
+		{name: "Gmail folded", addr: "Ford.Prefect+news@googlemail.com", foldGmail: true, expected: "fordprefect@gmail.com"},
+		{name: "Other domains not folded", addr: "ford.prefect+news@example.com", foldGmail: true, expected: "ford.prefect+news@example.com"},
+		{name: "Nothing left after folding", addr: "+news@gmail.com", foldGmail: true, wantErr: true},
+		{name: "Invalid domain", addr: "ford@exa_mple.com", wantErr: true},
+		{name: "Missing domain", addr: "ford@", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.foldGmail {
+				os.Setenv("NORMALIZE_GMAIL", "true")
+				defer os.Unsetenv("NORMALIZE_GMAIL")
+			}
+
+			got, err := normalizeEmail(tt.addr)
+
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestParseSubscriberEmail(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		env      map[string]string
+		expected string
+		wantErr  bool
+	}{
+		{name: "Bare address", raw: " Ford@Example.com ", expected: "ford@example.com"},
+		{name: "Display name", raw: "\"Evil\" <ford@example.com>", wantErr: true},
+		{name: "Empty display name", raw: "\"\" <ford@example.com>", wantErr: true},
+		{name: "Angle brackets", raw: "<ford@example.com>", wantErr: true},
+		{name: "Comment", raw: "ford@example.com (Ford)", wantErr: true},
+		{name: "Group", raw: "friends: ford@example.com;", wantErr: true},
+		{name: "Quoted local part", raw: "\"ford prefect\"@example.com", wantErr: true},
+		{
+			name:     "Quoted local part allowed",
+			raw:      "\"Ford Prefect\"@example.com",
+			env:      map[string]string{"ALLOW_QUOTED_LOCAL_PART": "true"},
+			expected: "\"ford prefect\"@example.com",
+		},
+		{
+			name:     "Needless quotes dropped",
+			raw:      "\"ford\"@example.com",
+			env:      map[string]string{"ALLOW_QUOTED_LOCAL_PART": "true"},
+			expected: "ford@example.com",
+		},
+		{name: "IP literal domain", raw: "ford@[192.0.2.1]", wantErr: true},
+		{name: "Numeric domain", raw: "ford@192.0.2.1", wantErr: true},
+		{name: "Dotless domain", raw: "ford@localhost", wantErr: true},
+		{name: "Leading hyphen in label", raw: "ford@-example.com", wantErr: true},
+		{name: "Local part too long", raw: strings.Repeat("a", 65) + "@example.com", wantErr: true},
+		{name: "Local part at limit", raw: strings.Repeat("a", 64) + "@example.com", expected: strings.Repeat("a", 64) + "@example.com"},
+		{name: "Address too long", raw: "ford@" + strings.Repeat(strings.Repeat("a", 63)+".", 4) + "com", wantErr: true},
+		{
+			name:    "Denied domain",
+			raw:     "ford@mail.example.org",
+			env:     map[string]string{"EMAIL_DOMAIN_DENYLIST": "example.net, Example.org"},
+			wantErr: true,
+		},
+		{
+			name:     "Allowed subdomain",
+			raw:      "ford@mail.example.com",
+			env:      map[string]string{"EMAIL_DOMAIN_ALLOWLIST": "example.com"},
+			expected: "ford@mail.example.com",
+		},
+		{
+			name:    "Not on allowlist",
+			raw:     "ford@notexample.com",
+			env:     map[string]string{"EMAIL_DOMAIN_ALLOWLIST": "example.com"},
+			wantErr: true,
+		},
+		{
+			name:    "Denylist wins",
+			raw:     "ford@bad.example.com",
+			env:     map[string]string{"EMAIL_DOMAIN_ALLOWLIST": "example.com", "EMAIL_DOMAIN_DENYLIST": "bad.example.com"},
+			wantErr: true,
+		},
+		{
+			name:     "Internationalized allowlist entry",
+			raw:      "ford@bücher.example",
+			env:      map[string]string{"EMAIL_DOMAIN_ALLOWLIST": "Bücher.example"},
+			expected: "ford@xn--bcher-kva.example",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+
+			got, err := parseSubscriberEmail(tt.raw)
+
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestMatchEmailWithId(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+
+	key := func(email string) any {
+		return mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+			return in.Key["email"].(*dynamodbtypes.AttributeValueMemberS).Value == email
+		})
+	}
+
+	t.Run("Normalized address", func(t *testing.T) {
+		mockSvc := new(MockDynamoDBClient)
+		mockSvc.On("GetItem", mock.Anything, key("ford@example.com")).Return(&dynamodb.GetItemOutput{
+			Item: subscriberItem("ford@example.com", "1", true, "2024-01-01 00:00:00"),
+		}, nil).Once()
+
+		email, match, err := matchEmailWithId(context.Background(), mockSvc, "Ford@Example.com", "1")
+
+		assert.NoError(t, err)
+		assert.True(t, match)
+		assert.Equal(t, "ford@example.com", email)
+		mockSvc.AssertExpectations(t)
+	})
+
+	t.Run("Item saved before normalization", func(t *testing.T) {
+		mockSvc := new(MockDynamoDBClient)
+		mockSvc.On("GetItem", mock.Anything, key("ford@example.com")).Return(&dynamodb.GetItemOutput{}, nil).Once()
+		mockSvc.On("GetItem", mock.Anything, key("Ford@Example.com")).Return(&dynamodb.GetItemOutput{
+			Item: subscriberItem("Ford@Example.com", "1", true, "2024-01-01 00:00:00"),
+		}, nil).Once()
+
+		email, match, err := matchEmailWithId(context.Background(), mockSvc, "Ford@Example.com", "1")
+
+		assert.NoError(t, err)
+		assert.True(t, match)
+		assert.Equal(t, "Ford@Example.com", email)
+		mockSvc.AssertExpectations(t)
+	})
+
+	t.Run("No match", func(t *testing.T) {
+		mockSvc := new(MockDynamoDBClient)
+		mockSvc.On("GetItem", mock.Anything, key("ford@example.com")).Return(&dynamodb.GetItemOutput{}, nil).Once()
+
+		_, match, err := matchEmailWithId(context.Background(), mockSvc, "ford@example.com", "1")
+
+		assert.NoError(t, err)
+		assert.False(t, match)
+		mockSvc.AssertExpectations(t)
+	})
+}
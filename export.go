@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// exportRecord is one confirmed subscriber in an export. The id is included so
+// unsubscribe links can be built from the export.
+type exportRecord struct {
+	Email       string            `json:"email"`
+	ID          string            `json:"id"`
+	ConfirmedAt string            `json:"confirmed_at"`
+	Fields      map[string]string `json:"fields,omitempty"`
+	// Evidence of consent, for subscribers who signed up or confirmed since it
+	// was first recorded.
+	SubscribeConsent *consentRecord `json:"subscribe_consent,omitempty"`
+	VerifyConsent    *consentRecord `json:"verify_consent,omitempty"`
+}
+
+// Columns for each consent record in a CSV export, after a "subscribe_" or "verify_" prefix.
+var consentColumns = []string{"time", "ip", "user_agent", "page", "version"}
+
+// Return the CSV values for a consent record, empty if there is none.
+func consentValues(c *consentRecord) []string {
+	if c == nil {
+		return make([]string, len(consentColumns))
+	}
+	// The user agent and page come from request headers, so anyone can set them.
+	return []string{c.Time, c.IP, csvCell(c.UserAgent), csvCell(c.Page), c.Version}
+}
+
+// Return a value that spreadsheets will show as text rather than run as a
+// formula. Values that could start one get a leading "'".
+func csvCell(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+// Write confirmed subscribers to a file or stdout as CSV or JSON Lines.
+func runExport(ctx context.Context, clients *ServiceClients, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "csv", "output format: csv or jsonl")
+	output := flags.String("o", "", "file to write to (default stdout)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	w := stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	count, err := exportSubscribers(ctx, clients.DynamoDB, *format, w)
+	if err != nil {
+		return err
+	}
+	loggerFrom(ctx).Info("exported confirmed subscribers", "count", count, "format", *format)
+	return nil
+}
+
+// Stream every confirmed subscriber to w in the given format, a scan page at a
+// time, so the whole list is never held in memory. Returns how many were written.
+func exportSubscribers(ctx context.Context, svc DynamoDBAPI, format string, w io.Writer) (int, error) {
+	var write func(exportRecord) error
+	var flush func() error
+
+	switch format {
+	case "csv":
+		// Each custom field in SUBSCRIBER_FIELDS gets a column.
+		specs, err := subscriberFieldSpecs()
+		if err != nil {
+			return 0, err
+		}
+		header := []string{"email", "id", "confirmed_at"}
+		for _, prefix := range []string{"subscribe_", "verify_"} {
+			for _, col := range consentColumns {
+				header = append(header, prefix+col)
+			}
+		}
+		for _, spec := range specs {
+			header = append(header, spec.Name)
+		}
+		cw := csv.NewWriter(w)
+		if err := cw.Write(header); err != nil {
+			return 0, err
+		}
+		write = func(r exportRecord) error {
+			// An address's local part can start with a formula character.
+			row := []string{csvCell(r.Email), r.ID, r.ConfirmedAt}
+			row = append(row, consentValues(r.SubscribeConsent)...)
+			row = append(row, consentValues(r.VerifyConsent)...)
+			// Custom fields are whatever subscribers typed.
+			for _, spec := range specs {
+				row = append(row, csvCell(r.Fields[spec.Name]))
+			}
+			return cw.Write(row)
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		write = func(r exportRecord) error {
+			return enc.Encode(r)
+		}
+		flush = func() error { return nil }
+	default:
+		return 0, fmt.Errorf("unknown export format %q: use csv or jsonl", format)
+	}
+
+	count := 0
+	err := scanSubscribersByConfirm(ctx, svc, true, func(sub subscriber) error {
+		count++
+		return write(exportRecord{
+			Email:            sub.Email,
+			ID:               sub.ID,
+			ConfirmedAt:      sub.ConfirmedAt,
+			Fields:           sub.Fields,
+			SubscribeConsent: sub.SubscribeConsent,
+			VerifyConsent:    sub.VerifyConsent,
+		})
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, flush()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestExportSubscribers(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+
+	tests := []struct {
+		name          string
+		format        string
+		fields        string
+		mockScanErr   error
+		expectedOut   string
+		expectedCount int
+		expectedErr   string
+	}{
+		{
+			name:   "CSV",
+			format: "csv",
+			expectedOut: "email,id,confirmed_at,subscribe_time,subscribe_ip,subscribe_user_agent,subscribe_page,subscribe_version,verify_time,verify_ip,verify_user_agent,verify_page,verify_version\n" +
+				"a@example.com,1,2024-01-01T00:00:00Z,,,,,,2024-01-01T00:00:00Z,192.0.2.1,Mozilla/5.0,https://example.com/,v1\n" +
+				"\"\"\"b,c\"\"@example.com\",2,2024-01-02T00:00:00Z,,,,,,,,,,\n",
+			expectedCount: 2,
+		},
+		{
+			name:   "JSON Lines",
+			format: "jsonl",
+			expectedOut: "{\"email\":\"a@example.com\",\"id\":\"1\",\"confirmed_at\":\"2024-01-01T00:00:00Z\",\"fields\":{\"first_name\":\"Ford\"}," +
+				"\"verify_consent\":{\"ip\":\"192.0.2.1\",\"user_agent\":\"Mozilla/5.0\",\"time\":\"2024-01-01T00:00:00Z\",\"page\":\"https://example.com/\",\"version\":\"v1\"}}\n" +
+				"{\"email\":\"\\\"b,c\\\"@example.com\",\"id\":\"2\",\"confirmed_at\":\"2024-01-02T00:00:00Z\"}\n",
+			expectedCount: 2,
+		},
+		{
+			name:   "CSV with custom fields",
+			format: "csv",
+			fields: "first_name,source",
+			expectedOut: "email,id,confirmed_at,subscribe_time,subscribe_ip,subscribe_user_agent,subscribe_page,subscribe_version,verify_time,verify_ip,verify_user_agent,verify_page,verify_version,first_name,source\n" +
+				"a@example.com,1,2024-01-01T00:00:00Z,,,,,,2024-01-01T00:00:00Z,192.0.2.1,Mozilla/5.0,https://example.com/,v1,Ford,\n" +
+				"\"\"\"b,c\"\"@example.com\",2,2024-01-02T00:00:00Z,,,,,,,,,,,,\n",
+			expectedCount: 2,
+		},
+		{
+			name:        "Unknown format",
+			format:      "xml",
+			expectedErr: "unknown export format",
+		},
+		{
+			name:        "Scan error",
+			format:      "csv",
+			mockScanErr: errors.New("scan error"),
+			expectedErr: "scan error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("SUBSCRIBER_FIELDS", tt.fields)
+			defer os.Unsetenv("SUBSCRIBER_FIELDS")
+			first := subscriberItem("a@example.com", "1", true, "2024-01-01 00:00:00")
+			first["fields"] = &dynamodbtypes.AttributeValueMemberM{Value: map[string]dynamodbtypes.AttributeValue{
+				"first_name": &dynamodbtypes.AttributeValueMemberS{Value: "Ford"},
+			}}
+			consent, err := attributevalue.Marshal(consentRecord{IP: "192.0.2.1", UserAgent: "Mozilla/5.0", Time: "2024-01-01T00:00:00Z", Page: "https://example.com/", Version: "v1"})
+			assert.NoError(t, err)
+			first["verify_consent"] = consent
+			mockSvc := new(MockDynamoDBClient)
+			if tt.format != "xml" {
+				mockSvc.On("Scan", mock.Anything, mock.MatchedBy(func(in *dynamodb.ScanInput) bool {
+					v := in.ExpressionAttributeValues[":confirmval"].(*dynamodbtypes.AttributeValueMemberBOOL)
+					return v.Value
+				})).Return(&dynamodb.ScanOutput{
+					Items: []map[string]dynamodbtypes.AttributeValue{
+						first,
+						subscriberItem("\"b,c\"@example.com", "2", true, "2024-01-02 00:00:00"),
+					},
+				}, tt.mockScanErr).Once()
+			}
+
+			var out bytes.Buffer
+			count, err := exportSubscribers(context.Background(), mockSvc, tt.format, &out)
+
+			if tt.expectedErr != "" {
+				assert.ErrorContains(t, err, tt.expectedErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expectedCount, count)
+				assert.Equal(t, tt.expectedOut, out.String())
+			}
+			mockSvc.AssertExpectations(t)
+		})
+	}
+}
+
+func TestCSVCell(t *testing.T) {
+	tests := map[string]string{
+		"":                        "",
+		"Ford":                    "Ford",
+		"=HYPERLINK(\"x\")":       "'=HYPERLINK(\"x\")",
+		"+1":                      "'+1",
+		"-1":                      "'-1",
+		"@SUM(A1)":                "'@SUM(A1)",
+		"\t=1":                    "'\t=1",
+		"a=b":                     "a=b",
+		"https://example.com/?=1": "https://example.com/?=1",
+	}
+	for in, want := range tests {
+		assert.Equal(t, want, csvCell(in), in)
+	}
+}
+
+func TestConsentValuesAreEscaped(t *testing.T) {
+	c := &consentRecord{Time: "2024-01-01T00:00:00Z", IP: "192.0.2.0", UserAgent: "=cmd|' /C calc'!A0", Page: "@SUM(A1)", Version: "v1"}
+	assert.Equal(t, []string{"2024-01-01T00:00:00Z", "192.0.2.0", "'=cmd|' /C calc'!A0", "'@SUM(A1)", "v1"}, consentValues(c))
+	assert.Equal(t, make([]string, len(consentColumns)), consentValues(nil))
+}
+
+func TestExportEscapesEmail(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	email := "=cmd|'/Ccalc'!A0@evil.example"
+	_, err := parseSubscriberEmail(email)
+	assert.NoError(t, err)
+
+	mockSvc := new(MockDynamoDBClient)
+	mockSvc.On("Scan", mock.Anything, mock.AnythingOfType("*dynamodb.ScanInput")).Return(&dynamodb.ScanOutput{
+		Items: []map[string]dynamodbtypes.AttributeValue{subscriberItem(email, "1", true, "2024-01-01 00:00:00")},
+	}, nil).Once()
+
+	var out bytes.Buffer
+	_, err = exportSubscribers(context.Background(), mockSvc, "csv", &out)
+
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "\n'=cmd|'/Ccalc'!A0@evil.example,1,")
+	mockSvc.AssertExpectations(t)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Feed state is kept in the subscriber table under a key that can't be an
+// email address. It has no confirm attribute, so it is never sent mail.
+const feedStateKeyPrefix = "feed#"
+
+// The most mailed items remembered for a feed. Items are remembered after they
+// leave the feed, so one that comes back, like an edited post, isn't mailed
+// again, but only the most recent are kept so the state item stays well under
+// DynamoDB's item size limit.
+const maxFeedItemsRemembered = 500
+
+// The templates used for feed items unless others are given.
+const (
+	defaultFeedHTML = `<h1><a href="{{.Item.Link}}">{{.Item.Title}}</a></h1>
+<p>{{.Item.Summary}}</p>
+<p><a href="{{.Item.Link}}">Read more</a></p>
+<p><small>You're receiving this because you subscribed to my list. <a href="{{.UnsubscribeURL}}">Unsubscribe</a>.</small></p>`
+	defaultFeedText = `{{.Item.Title}}
+
+{{.Item.Summary}}
+
+Read more: {{.Item.Link}}
+
+You're receiving this because you subscribed to my list. Unsubscribe: {{.UnsubscribeURL}}`
+)
+
+// feedItem is one post in an RSS or Atom feed.
+type feedItem struct {
+	GUID    string
+	Title   string
+	Link    string
+	Summary string
+}
+
+// feedReport describes what a feed run found and sent.
+type feedReport struct {
+	New    int
+	Mailed int
+	// Set when the feed was seen for the first time, so nothing was mailed.
+	Initialized bool
+}
+
+// Mail new feed items to confirmed subscribers from the command line.
+func runFeed(ctx context.Context, clients *ServiceClients, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("feed", flag.ContinueOnError)
+	feedURL := flags.String("url", os.Getenv("FEED_URL"), "RSS or Atom feed URL")
+	htmlPath := flags.String("html", os.Getenv("FEED_HTML_TEMPLATE"), "HTML template file (default: a built-in template)")
+	textPath := flags.String("text", os.Getenv("FEED_TEXT_TEMPLATE"), "plain text template file (default: a built-in template)")
+	dryRun := flags.Bool("dry-run", false, "list new items without mailing them or recording them as sent")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *feedURL == "" {
+		return errors.New("usage: simple-subscribe feed -url <feed URL> [-html file] [-text file] [-dry-run]")
+	}
+
+	n, err := loadFeedTemplates(*htmlPath, *textPath)
+	if err != nil {
+		return err
+	}
+	report, err := mailFeed(ctx, clients, *feedURL, n, *dryRun)
+	if report.Initialized {
+		fmt.Fprintf(w, "first run for this feed: recorded %d existing items without mailing them\n", report.New)
+		return err
+	}
+	fmt.Fprintf(w, "new items: %d\nmailed: %d\n", report.New, report.Mailed)
+	return err
+}
+
+// Parse the templates for feed items from files, using the built-in
+// templates for any path that is empty.
+func loadFeedTemplates(htmlPath string, textPath string) (newsletter, error) {
+	html, text := defaultFeedHTML, defaultFeedText
+	if htmlPath != "" {
+		b, err := os.ReadFile(htmlPath)
+		if err != nil {
+			return newsletter{}, err
+		}
+		html = string(b)
+	}
+	if textPath != "" {
+		b, err := os.ReadFile(textPath)
+		if err != nil {
+			return newsletter{}, err
+		}
+		text = string(b)
+	}
+	return parseNewsletter("", html, text)
+}
+
+// Fetch a feed and mail each item that hasn't been mailed before to every
+// confirmed subscriber, oldest first. The first time a feed is seen, its
+// current items are recorded without being mailed, so subscribers don't get
+// the whole archive.
+//
+// An item is recorded as mailed before it is sent, so if a run is cut short,
+// some subscribers may miss it but nobody is sent it twice.
+func mailFeed(ctx context.Context, clients *ServiceClients, feedURL string, n newsletter, dryRun bool) (feedReport, error) {
+	var report feedReport
+	log := loggerFrom(ctx).With("feed", feedURL)
+
+	items, err := fetchFeed(ctx, feedURL)
+	if err != nil {
+		return report, err
+	}
+	seen, exists, err := getFeedState(ctx, clients.DynamoDB, feedURL)
+	if err != nil {
+		return report, err
+	}
+
+	var fresh []feedItem
+	for _, item := range items {
+		if _, ok := seen[item.GUID]; !ok {
+			fresh = append(fresh, item)
+		}
+	}
+	// Feeds list the newest item first.
+	slices.Reverse(fresh)
+	report.New = len(fresh)
+
+	if dryRun {
+		for _, item := range fresh {
+			log.Info("would mail feed item", "title", item.Title, "link", item.Link)
+		}
+		return report, nil
+	}
+
+	now := clock()
+	if !exists {
+		report.Initialized = true
+		seen = make(map[string]int64, len(items))
+		for _, item := range items {
+			seen[item.GUID] = now.Unix()
+		}
+		log.Info("first run for feed, recording existing items", "items", len(items))
+		return report, saveFeedState(ctx, clients.DynamoDB, feedURL, seen)
+	}
+
+	if len(fresh) == 0 {
+		return report, nil
+	}
+	rate := sesSendRate(ctx, clients.SES)
+	for _, item := range fresh {
+		seen[item.GUID] = now.Unix()
+		if err := saveFeedState(ctx, clients.DynamoDB, feedURL, seen); err != nil {
+			return report, err
+		}
+		n.Subject = item.Title
+		n.Item = &item
+		sent, err := sendNewsletter(ctx, clients, n, nil, rate)
+		log.Info("mailed feed item", "title", item.Title, "sent", sent.Sent, "failed", sent.Failed)
+		if err != nil {
+			return report, err
+		}
+		report.Mailed++
+	}
+	return report, nil
+}
+
+// Download and parse an RSS 2.0 or Atom feed.
+func fetchFeed(ctx context.Context, feedURL string) ([]feedItem, error) {
+	ctx, cancel := withTimeout(ctx, "FEED_TIMEOUT", 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "simple-subscribe")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch feed: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseFeed(body)
+}
+
+// Parse the items of an RSS 2.0 or Atom feed. Items are identified by their
+// guid or id, or by their link if they have none.
+func parseFeed(body []byte) ([]feedItem, error) {
+	var doc struct {
+		XMLName xml.Name
+		// RSS
+		Items []struct {
+			GUID        string `xml:"guid"`
+			Title       string `xml:"title"`
+			Link        string `xml:"link"`
+			Description string `xml:"description"`
+		} `xml:"channel>item"`
+		// Atom
+		Entries []struct {
+			ID    string `xml:"id"`
+			Title string `xml:"title"`
+			Links []struct {
+				Href string `xml:"href,attr"`
+				Rel  string `xml:"rel,attr"`
+			} `xml:"link"`
+			Summary string `xml:"summary"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("could not parse feed: %w", err)
+	}
+
+	var items []feedItem
+	switch doc.XMLName.Local {
+	case "rss":
+		for _, i := range doc.Items {
+			items = append(items, feedItem{GUID: i.GUID, Title: i.Title, Link: i.Link, Summary: stripHTML(i.Description)})
+		}
+	case "feed":
+		for _, e := range doc.Entries {
+			item := feedItem{GUID: e.ID, Title: e.Title, Summary: stripHTML(e.Summary)}
+			for _, l := range e.Links {
+				if l.Rel == "" || l.Rel == "alternate" {
+					item.Link = l.Href
+					break
+				}
+			}
+			items = append(items, item)
+		}
+	default:
+		return nil, fmt.Errorf("not an RSS or Atom feed: <%s>", doc.XMLName.Local)
+	}
+
+	for i := range items {
+		if items[i].GUID == "" {
+			items[i].GUID = items[i].Link
+		}
+	}
+	return items, nil
+}
+
+// Reduce a feed summary to plain text. Summaries are usually HTML, which the
+// templates would otherwise show as literal markup, and a feed isn't trusted
+// enough to put its markup in an email as it is.
+func stripHTML(s string) string {
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(s))
+	skip := 0
+	for {
+		switch tt := z.Next(); tt {
+		case html.ErrorToken:
+			return strings.Join(strings.Fields(b.String()), " ")
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(z.Text())
+			}
+		case html.StartTagToken, html.EndTagToken:
+			name, _ := z.TagName()
+			if a := atom.Lookup(name); a == atom.Script || a == atom.Style {
+				if tt == html.StartTagToken {
+					skip++
+				} else if skip > 0 {
+					skip--
+				}
+			}
+			// Tags like <p> and <br> separate words.
+			b.WriteByte(' ')
+		}
+	}
+}
+
+// Get the ids of items already mailed for a feed, with when each was first
+// recorded in Unix seconds, and whether the feed has been seen before.
+func getFeedState(ctx context.Context, svc DynamoDBAPI, feedURL string) (map[string]int64, bool, error) {
+	ctx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "DynamoDB", "GetItem")
+	defer span.End()
+	defer observeBackend("GetItem", time.Now())
+	result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"email": &dynamodbtypes.AttributeValueMemberS{Value: feedStateKeyPrefix + feedURL},
+		},
+		TableName: aws.String(os.Getenv("DB_TABLE_NAME")),
+	})
+	if err != nil {
+		recordSpanError(span, err)
+		loggerFrom(ctx).Error("could not get feed state", "error", err)
+		return nil, false, err
+	}
+	if result.Item == nil {
+		return nil, false, nil
+	}
+	seen := make(map[string]int64)
+	// Earlier versions kept a set of ids with no times. They count as oldest.
+	if sent, ok := result.Item["sent"].(*dynamodbtypes.AttributeValueMemberSS); ok {
+		for _, guid := range sent.Value {
+			seen[guid] = 0
+		}
+	}
+	if recent, ok := result.Item["recent"]; ok {
+		var times map[string]int64
+		if err := attributevalue.Unmarshal(recent, &times); err != nil {
+			return nil, false, err
+		}
+		maps.Copy(seen, times)
+	}
+	return seen, true, nil
+}
+
+// Save the items mailed for a feed, keeping only the most recent
+// maxFeedItemsRemembered.
+func saveFeedState(ctx context.Context, svc DynamoDBAPI, feedURL string, seen map[string]int64) error {
+	recent, err := attributevalue.Marshal(recentFeedItems(seen, maxFeedItemsRemembered))
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.UpdateItemInput{
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"email": &dynamodbtypes.AttributeValueMemberS{Value: feedStateKeyPrefix + feedURL},
+		},
+		ExpressionAttributeNames: map[string]string{
+			"#U": "updated",
+			"#R": "recent",
+			"#S": "sent",
+		},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":updated": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(clock().Unix(), 10)},
+			":recent":  recent,
+		},
+		// The legacy set is folded into recent, so it can go.
+		UpdateExpression: aws.String("SET #U = :updated, #R = :recent REMOVE #S"),
+		TableName:        aws.String(os.Getenv("DB_TABLE_NAME")),
+	}
+
+	ctx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "DynamoDB", "UpdateItem")
+	defer span.End()
+	defer observeBackend("UpdateItem", time.Now())
+	if _, err := svc.UpdateItem(ctx, input); err != nil {
+		recordSpanError(span, err)
+		loggerFrom(ctx).Error("could not update feed state", "error", err)
+		return err
+	}
+	return nil
+}
+
+// Return the newest n items of seen, breaking ties by id so the choice is
+// stable.
+func recentFeedItems(seen map[string]int64, n int) map[string]int64 {
+	if len(seen) <= n {
+		return seen
+	}
+	guids := slices.Collect(maps.Keys(seen))
+	slices.SortFunc(guids, func(a, b string) int {
+		if c := cmp.Compare(seen[b], seen[a]); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	recent := make(map[string]int64, n)
+	for _, guid := range guids[:n] {
+		recent[guid] = seen[guid]
+	}
+	return recent
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testRSS = `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Blog</title>
+<item><title>Second</title><link>https://example.com/2</link><guid>2</guid><description>Two</description></item>
+<item><title>First</title><link>https://example.com/1</link><description>One</description></item>
+</channel></rss>`
+
+const testAtom = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><title>Blog</title>
+<entry><title>Post</title><id>urn:post</id><link rel="self" href="https://example.com/post.xml"/><link href="https://example.com/post"/><summary>A post</summary></entry>
+</feed>`
+
+func TestParseFeed(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []feedItem
+		wantErr string
+	}{
+		{
+			name: "RSS",
+			body: testRSS,
+			want: []feedItem{
+				{GUID: "2", Title: "Second", Link: "https://example.com/2", Summary: "Two"},
+				{GUID: "https://example.com/1", Title: "First", Link: "https://example.com/1", Summary: "One"},
+			},
+		},
+		{
+			name: "Atom",
+			body: testAtom,
+			want: []feedItem{
+				{GUID: "urn:post", Title: "Post", Link: "https://example.com/post", Summary: "A post"},
+			},
+		},
+		{
+			name: "HTML summaries",
+			body: `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Blog</title>
+<item><title>Post</title><link>https://example.com/post</link><description><![CDATA[<p>Fish &amp; <b>chips</b></p><script>alert(1)</script><p>Second&nbsp;paragraph</p>]]></description></item>
+<item><title>Escaped</title><link>https://example.com/escaped</link><description>&lt;p&gt;An &lt;em&gt;escaped&lt;/em&gt; post&lt;br&gt;ends here&lt;/p&gt;</description></item>
+</channel></rss>`,
+			want: []feedItem{
+				{GUID: "https://example.com/post", Title: "Post", Link: "https://example.com/post", Summary: "Fish & chips Second paragraph"},
+				{GUID: "https://example.com/escaped", Title: "Escaped", Link: "https://example.com/escaped", Summary: "An escaped post ends here"},
+			},
+		},
+		{
+			name:    "Not a feed",
+			body:    `<html></html>`,
+			wantErr: "not an RSS or Atom feed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := parseFeed([]byte(tt.body))
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, items)
+		})
+	}
+}
+
+func TestMailFeed(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testRSS))
+	}))
+	defer server.Close()
+
+	stateKey := func(in *dynamodb.GetItemInput) bool {
+		return in.Key["email"].(*dynamodbtypes.AttributeValueMemberS).Value == "feed#"+server.URL
+	}
+	marks := func(guids ...string) any {
+		return mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+			var recent map[string]int64
+			if err := attributevalue.Unmarshal(in.ExpressionAttributeValues[":recent"], &recent); err != nil {
+				return false
+			}
+			return assert.ObjectsAreEqual(guids, slices.Sorted(maps.Keys(recent)))
+		})
+	}
+
+	t.Run("First run records items without mailing", func(t *testing.T) {
+		mockDynamoDB := new(MockDynamoDBClient)
+		mockSES := new(MockSESClient)
+		mockDynamoDB.On("GetItem", mock.Anything, mock.MatchedBy(stateKey)).Return(&dynamodb.GetItemOutput{}, nil).Once()
+		mockDynamoDB.On("UpdateItem", mock.Anything, marks("2", "https://example.com/1")).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+
+		n, err := loadFeedTemplates("", "")
+		assert.NoError(t, err)
+		report, err := mailFeed(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB, SES: mockSES}, server.URL, n, false)
+
+		assert.NoError(t, err)
+		assert.Equal(t, feedReport{New: 2, Initialized: true}, report)
+		mockDynamoDB.AssertExpectations(t)
+		mockSES.AssertNotCalled(t, "SendEmail", mock.Anything, mock.Anything)
+	})
+
+	t.Run("New items are mailed oldest first", func(t *testing.T) {
+		mockDynamoDB := new(MockDynamoDBClient)
+		mockSES := new(MockSESClient)
+		mockDynamoDB.On("GetItem", mock.Anything, mock.MatchedBy(stateKey)).Return(&dynamodb.GetItemOutput{
+			Item: map[string]dynamodbtypes.AttributeValue{
+				"email": &dynamodbtypes.AttributeValueMemberS{Value: "feed#" + server.URL},
+				"sent":  &dynamodbtypes.AttributeValueMemberSS{Value: []string{"2"}},
+			},
+		}, nil).Once()
+		mockDynamoDB.On("UpdateItem", mock.Anything, marks("2", "https://example.com/1")).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+		mockSES.On("GetSendQuota", mock.Anything, mock.Anything).Return(&ses.GetSendQuotaOutput{MaxSendRate: 1000}, nil).Once()
+		mockDynamoDB.On("Scan", mock.Anything, mock.AnythingOfType("*dynamodb.ScanInput")).Return(&dynamodb.ScanOutput{
+			Items: []map[string]dynamodbtypes.AttributeValue{
+				subscriberItem("reader@example.com", "1", true, "2024-01-01 00:00:00"),
+			},
+		}, nil).Once()
+		mockSES.On("SendEmail", mock.Anything, mock.MatchedBy(func(in *ses.SendEmailInput) bool {
+			return *in.Message.Subject.Data == "First" && assert.ObjectsAreEqual([]string{"reader@example.com"}, in.Destination.ToAddresses)
+		})).Return(&ses.SendEmailOutput{}, nil).Once()
+
+		n, err := loadFeedTemplates("", "")
+		assert.NoError(t, err)
+		report, err := mailFeed(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB, SES: mockSES}, server.URL, n, false)
+
+		assert.NoError(t, err)
+		assert.Equal(t, feedReport{New: 1, Mailed: 1}, report)
+		mockDynamoDB.AssertExpectations(t)
+		mockSES.AssertExpectations(t)
+	})
+
+	t.Run("Items that left the feed are still remembered", func(t *testing.T) {
+		mockDynamoDB := new(MockDynamoDBClient)
+		mockSES := new(MockSESClient)
+		mockDynamoDB.On("GetItem", mock.Anything, mock.MatchedBy(stateKey)).Return(&dynamodb.GetItemOutput{
+			Item: map[string]dynamodbtypes.AttributeValue{
+				"email": &dynamodbtypes.AttributeValueMemberS{Value: "feed#" + server.URL},
+				"recent": &dynamodbtypes.AttributeValueMemberM{Value: map[string]dynamodbtypes.AttributeValue{
+					"0": &dynamodbtypes.AttributeValueMemberN{Value: "1704067200"},
+					"2": &dynamodbtypes.AttributeValueMemberN{Value: "1704153600"},
+				}},
+			},
+		}, nil).Once()
+		mockDynamoDB.On("UpdateItem", mock.Anything, marks("0", "2", "https://example.com/1")).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+		mockSES.On("GetSendQuota", mock.Anything, mock.Anything).Return(&ses.GetSendQuotaOutput{MaxSendRate: 1000}, nil).Once()
+		mockDynamoDB.On("Scan", mock.Anything, mock.AnythingOfType("*dynamodb.ScanInput")).Return(&dynamodb.ScanOutput{}, nil).Once()
+
+		n, err := loadFeedTemplates("", "")
+		assert.NoError(t, err)
+		report, err := mailFeed(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB, SES: mockSES}, server.URL, n, false)
+
+		assert.NoError(t, err)
+		assert.Equal(t, feedReport{New: 1, Mailed: 1}, report)
+		mockDynamoDB.AssertExpectations(t)
+	})
+}
+
+func TestRecentFeedItems(t *testing.T) {
+	seen := map[string]int64{"a": 30, "b": 10, "c": 20, "d": 20, "legacy": 0}
+
+	assert.Equal(t, seen, recentFeedItems(seen, 5))
+	assert.Equal(t, map[string]int64{"a": 30, "c": 20, "d": 20}, recentFeedItems(seen, 3))
+	assert.Equal(t, map[string]int64{"a": 30, "c": 20}, recentFeedItems(seen, 2))
+}
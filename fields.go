@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The longest value a custom field may have unless SUBSCRIBER_FIELDS says otherwise.
+const defaultFieldMaxLen = 100
+
+// Field names are short and safe to use as template keys and CSV headers.
+var fieldNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// fieldSpec is one custom field that may be given at signup.
+type fieldSpec struct {
+	Name   string
+	MaxLen int
+}
+
+// Read the custom fields allowed at signup from SUBSCRIBER_FIELDS, a
+// comma-separated list of names, each optionally followed by ":" and the
+// longest value allowed, e.g. "first_name:50,source,interests:200".
+func subscriberFieldSpecs() ([]fieldSpec, error) {
+	var specs []fieldSpec
+	for _, entry := range strings.Split(os.Getenv("SUBSCRIBER_FIELDS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, limit, hasLimit := strings.Cut(entry, ":")
+		spec := fieldSpec{Name: name, MaxLen: defaultFieldMaxLen}
+		if !fieldNamePattern.MatchString(name) || name == "email" || name == "id" {
+			return nil, fmt.Errorf("invalid field name in SUBSCRIBER_FIELDS: %q", name)
+		}
+		if hasLimit {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid length for field %s in SUBSCRIBER_FIELDS: %q", name, limit)
+			}
+			spec.MaxLen = n
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// Pick the allowed custom fields out of a signup request's parameters. Other
+// parameters are ignored, as are empty values. Returns nil if there are none,
+// or an error if a value is too long or has control characters.
+func parseSubscriberFields(specs []fieldSpec, params map[string]string) (map[string]string, error) {
+	var fields map[string]string
+	for _, spec := range specs {
+		v := strings.TrimSpace(params[spec.Name])
+		if v == "" {
+			continue
+		}
+		if !utf8.ValidString(v) || strings.IndexFunc(v, unicode.IsControl) >= 0 {
+			return nil, fmt.Errorf("field %s has invalid characters", spec.Name)
+		}
+		if utf8.RuneCountInString(v) > spec.MaxLen {
+			return nil, fmt.Errorf("field %s is longer than %d characters", spec.Name, spec.MaxLen)
+		}
+		if fields == nil {
+			fields = make(map[string]string)
+		}
+		fields[spec.Name] = v
+	}
+	return fields, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSubscriberFieldSpecs(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		want    []fieldSpec
+		wantErr string
+	}{
+		{name: "Unset", env: ""},
+		{
+			name: "Names and limits",
+			env:  "first_name:50, source ,interests:200",
+			want: []fieldSpec{{"first_name", 50}, {"source", defaultFieldMaxLen}, {"interests", 200}},
+		},
+		{name: "Bad name", env: "First Name", wantErr: "invalid field name"},
+		{name: "Reserved name", env: "email", wantErr: "invalid field name"},
+		{name: "Bad limit", env: "source:0", wantErr: "invalid length"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("SUBSCRIBER_FIELDS", tt.env)
+			defer os.Unsetenv("SUBSCRIBER_FIELDS")
+
+			specs, err := subscriberFieldSpecs()
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, specs)
+		})
+	}
+}
+
+func TestParseSubscriberFields(t *testing.T) {
+	specs := []fieldSpec{{"first_name", 5}, {"source", 100}}
+
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:   "Allowed fields are kept",
+			params: map[string]string{"email": "a@example.com", "first_name": " Ford ", "source": "blog", "admin": "true"},
+			want:   map[string]string{"first_name": "Ford", "source": "blog"},
+		},
+		{name: "No fields", params: map[string]string{"email": "a@example.com", "source": "  "}},
+		{name: "Too long", params: map[string]string{"first_name": strings.Repeat("é", 6)}, wantErr: "longer than 5 characters"},
+		{name: "Control characters", params: map[string]string{"source": "a\nb"}, wantErr: "invalid characters"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := parseSubscriberFields(specs, tt.params)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, fields)
+		})
+	}
+}
+
+func TestSubscribeStoresFields(t *testing.T) {
+	os.Setenv("SUBSCRIBE_PATH", "subscribe")
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	os.Setenv("SUBSCRIBER_FIELDS", "first_name:20")
+	defer os.Unsetenv("SUBSCRIBER_FIELDS")
+
+	mockDynamoDB := new(MockDynamoDBClient)
+	mockSES := new(MockSESClient)
+	mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{}, nil).Once()
+	expectNoTombstone(mockDynamoDB, "new@example.com")
+	mockDynamoDB.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+		fields, ok := in.ExpressionAttributeValues[":fieldsval"].(*dynamodbtypes.AttributeValueMemberM)
+		return ok && fields.Value["first_name"].(*dynamodbtypes.AttributeValueMemberS).Value == "Ford" &&
+			*in.UpdateExpression == "SET #C = :confirmval, #U = :nowval, #CA = if_not_exists(#CA, :nowval), #ID = :idval, #E = :expval, #F = :fieldsval, #CR = :consentval REMOVE #CF, #RC, #RA"
+	})).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+	mockSES.On("SendEmail", mock.Anything, mock.AnythingOfType("*ses.SendEmailInput")).Return(&ses.SendEmailOutput{}, nil).Once()
+
+	_, err := lambdaHandler(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB, SES: mockSES}, events.APIGatewayV2HTTPRequest{
+		RawPath:               "/subscribe/",
+		QueryStringParameters: map[string]string{"email": "new@example.com", "first_name": "Ford", "role": "admin"},
+	})
+
+	assert.NoError(t, err)
+	mockDynamoDB.AssertExpectations(t)
+	mockSES.AssertExpectations(t)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Actions recorded in a subscriber's history.
+const (
+	historySubscribed    = "subscribed"
+	historyResubscribed  = "resubscribed"
+	historyConfirmed     = "confirmed"
+	historyUnsubscribed  = "unsubscribed"
+	historyAdded         = "added"
+	historyImported      = "imported"
+	historyRemoved       = "removed"
+	historyOptOutCleared = "opt_out_cleared"
+)
+
+// Who made a change: the subscriber themselves or the list owner.
+const (
+	historyActorSelf  = "self"
+	historyActorAdmin = "admin"
+)
+
+// Layout of an event's time. Fixed-width nanoseconds keep events in order
+// when DynamoDB sorts them as strings.
+const historyTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// historyEvent is one change to a subscriber's state, kept in HISTORY_TABLE_NAME.
+// Events are keyed by the same salted hash as tombstones, so a subscriber's
+// history outlives their item without keeping their address.
+type historyEvent struct {
+	Subscriber string `dynamodbav:"subscriber" json:"-"`
+	Time       string `dynamodbav:"time" json:"time"`
+	Action     string `dynamodbav:"action" json:"action"`
+	Actor      string `dynamodbav:"actor" json:"actor"`
+	// The network the request came from, for changes made by the subscriber.
+	// It's kept after the subscriber leaves, so it's truncated by truncateIP.
+	IP string `dynamodbav:"ip,omitempty" json:"ip,omitempty"`
+}
+
+// Zero the host part of an IP address, keeping its /24 (IPv4) or /48 (IPv6)
+// network, so it no longer points at one subscriber. Anything else is dropped.
+func truncateIP(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return addr.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// Name the history table, or "" if HISTORY_TABLE_NAME is unset. History is
+// keyed by a hash salted with TOMBSTONE_SALT, so it needs that too.
+func historyTable() (string, error) {
+	table := os.Getenv("HISTORY_TABLE_NAME")
+	if table == "" {
+		return "", nil
+	}
+	return table, requireTombstoneSalt()
+}
+
+// Create the event for a change to an address made at now.
+func newHistoryEvent(email string, action string, actor string, ip string, now time.Time) historyEvent {
+	return historyEvent{
+		Subscriber: saltedEmailHash(email),
+		Time:       now.UTC().Format(historyTimeLayout),
+		Action:     action,
+		Actor:      actor,
+		IP:         truncateIP(ip),
+	}
+}
+
+// Append an event to a subscriber's history, if HISTORY_TABLE_NAME is set.
+// Failures are logged rather than returned, so the change itself still stands.
+func recordHistory(ctx context.Context, svc DynamoDBAPI, email string, action string, actor string, ip string) {
+	table, err := historyTable()
+	if err != nil {
+		loggerFrom(ctx).Error("could not record history", "error", err, "action", action)
+		return
+	}
+	if table == "" {
+		return
+	}
+	item, err := attributevalue.MarshalMap(newHistoryEvent(email, action, actor, ip, clock()))
+	if err != nil {
+		loggerFrom(ctx).Error("could not encode history event", "error", err)
+		return
+	}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(table),
+		Item:      item,
+		// History is append-only.
+		ConditionExpression:      aws.String("attribute_not_exists(#S)"),
+		ExpressionAttributeNames: map[string]string{"#S": "time"},
+	}
+
+	ctx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "DynamoDB", "PutItem")
+	defer span.End()
+	defer observeBackend("PutItem", time.Now())
+	if _, err := svc.PutItem(ctx, input); err != nil {
+		recordSpanError(span, err)
+		loggerFrom(ctx).Error("could not record history", "error", err, "action", action, logKeyEmail, email)
+	}
+}
+
+// Append the same event for many addresses at once, as an import does.
+func recordHistoryBatch(ctx context.Context, svc DynamoDBAPI, emails []string, action string, actor string) {
+	table, err := historyTable()
+	if err != nil {
+		loggerFrom(ctx).Error("could not record history", "error", err, "action", action)
+		return
+	}
+	if table == "" || len(emails) == 0 {
+		return
+	}
+	now := clock()
+	requests := make([]dynamodbtypes.WriteRequest, 0, len(emails))
+	for _, email := range emails {
+		item, err := attributevalue.MarshalMap(newHistoryEvent(email, action, actor, "", now))
+		if err != nil {
+			loggerFrom(ctx).Error("could not encode history event", "error", err)
+			return
+		}
+		requests = append(requests, dynamodbtypes.WriteRequest{PutRequest: &dynamodbtypes.PutRequest{Item: item}})
+	}
+	if err := batchWriteTable(ctx, svc, table, requests); err != nil {
+		loggerFrom(ctx).Error("could not record history", "error", err, "action", action)
+	}
+}
+
+// Get an address's history, oldest first. There is none if HISTORY_TABLE_NAME is unset.
+func getHistory(ctx context.Context, svc DynamoDBAPI, email string) ([]historyEvent, error) {
+	table, err := historyTable()
+	if table == "" || err != nil {
+		return nil, err
+	}
+	paginator := dynamodb.NewQueryPaginator(svc, &dynamodb.QueryInput{
+		TableName:                aws.String(table),
+		KeyConditionExpression:   aws.String("#S = :subscriber"),
+		ExpressionAttributeNames: map[string]string{"#S": "subscriber"},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":subscriber": &dynamodbtypes.AttributeValueMemberS{Value: saltedEmailHash(email)},
+		},
+	})
+
+	var events []historyEvent
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			loggerFrom(ctx).Error("could not query history", "error", err)
+			return nil, err
+		}
+		var pageEvents []historyEvent
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageEvents); err != nil {
+			return nil, err
+		}
+		events = append(events, pageEvents...)
+	}
+	return events, nil
+}
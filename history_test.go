@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNewHistoryEvent(t *testing.T) {
+	os.Setenv("TOMBSTONE_SALT", "pepper")
+	defer os.Unsetenv("TOMBSTONE_SALT")
+
+	now := time.Date(2024, 6, 1, 14, 0, 0, 5, time.FixedZone("CEST", 2*60*60))
+	e := newHistoryEvent("Ford@Example.com", historyConfirmed, historyActorSelf, "192.0.2.1", now)
+
+	assert.Equal(t, saltedEmailHash("ford@example.com"), e.Subscriber)
+	assert.Equal(t, "2024-06-01T12:00:00.000000005Z", e.Time)
+	assert.Equal(t, historyConfirmed, e.Action)
+	assert.Equal(t, historyActorSelf, e.Actor)
+	assert.Equal(t, "192.0.2.0", e.IP)
+}
+
+func TestTruncateIP(t *testing.T) {
+	assert.Equal(t, "192.0.2.0", truncateIP("192.0.2.77"))
+	assert.Equal(t, "2001:db8:85a3::", truncateIP("2001:db8:85a3:8d3:1319:8a2e:370:7348"))
+	assert.Equal(t, "", truncateIP("not an address"))
+	assert.Equal(t, "", truncateIP(""))
+}
+
+func TestHistoryNeedsSalt(t *testing.T) {
+	os.Setenv("HISTORY_TABLE_NAME", "History")
+	defer os.Unsetenv("HISTORY_TABLE_NAME")
+	os.Unsetenv("TOMBSTONE_SALT")
+
+	// Nothing is written under an unsalted hash.
+	mockSvc := new(MockDynamoDBClient)
+	recordHistory(context.Background(), mockSvc, "a@example.com", historyAdded, historyActorAdmin, "")
+	mockSvc.AssertExpectations(t)
+
+	_, err := getHistory(context.Background(), mockSvc, "a@example.com")
+	assert.ErrorContains(t, err, "TOMBSTONE_SALT")
+}
+
+func TestRecordHistoryWithoutTable(t *testing.T) {
+	os.Unsetenv("HISTORY_TABLE_NAME")
+
+	// Nothing is written when history is off.
+	mockSvc := new(MockDynamoDBClient)
+	recordHistory(context.Background(), mockSvc, "a@example.com", historyAdded, historyActorAdmin, "")
+	mockSvc.AssertExpectations(t)
+}
+
+func TestSubscribeRecordsHistory(t *testing.T) {
+	os.Setenv("SUBSCRIBE_PATH", "subscribe")
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	os.Setenv("HISTORY_TABLE_NAME", "History")
+	defer os.Unsetenv("HISTORY_TABLE_NAME")
+	os.Setenv("TOMBSTONE_SALT", "pepper")
+	defer os.Unsetenv("TOMBSTONE_SALT")
+
+	tests := []struct {
+		name           string
+		previous       map[string]dynamodbtypes.AttributeValue
+		expectedAction string
+	}{
+		{name: "New address", expectedAction: historySubscribed},
+		{
+			name: "Expired request",
+			previous: map[string]dynamodbtypes.AttributeValue{
+				"email":      &dynamodbtypes.AttributeValueMemberS{Value: "a@example.com"},
+				"id":         &dynamodbtypes.AttributeValueMemberS{Value: "1"},
+				"confirm":    &dynamodbtypes.AttributeValueMemberBOOL{Value: false},
+				"created_at": &dynamodbtypes.AttributeValueMemberS{Value: "2024-01-01T00:00:00Z"},
+				"expires_at": &dynamodbtypes.AttributeValueMemberN{Value: "1704326400"},
+			},
+			expectedAction: historyResubscribed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDynamoDB := new(MockDynamoDBClient)
+			mockSES := new(MockSESClient)
+			mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{Item: tt.previous}, nil).Once()
+			expectNoTombstone(mockDynamoDB, "a@example.com")
+			mockDynamoDB.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+				return in.ReturnValues == dynamodbtypes.ReturnValueAllOld
+			})).Return(&dynamodb.UpdateItemOutput{Attributes: tt.previous}, nil).Once()
+			mockSES.On("SendEmail", mock.Anything, mock.AnythingOfType("*ses.SendEmailInput")).Return(&ses.SendEmailOutput{}, nil).Once()
+			mockDynamoDB.On("PutItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.PutItemInput) bool {
+				return *in.TableName == "History" &&
+					in.Item["subscriber"].(*dynamodbtypes.AttributeValueMemberS).Value == saltedEmailHash("a@example.com") &&
+					in.Item["action"].(*dynamodbtypes.AttributeValueMemberS).Value == tt.expectedAction &&
+					in.Item["actor"].(*dynamodbtypes.AttributeValueMemberS).Value == historyActorSelf &&
+					in.Item["ip"].(*dynamodbtypes.AttributeValueMemberS).Value == "192.0.2.0" &&
+					*in.ConditionExpression == "attribute_not_exists(#S)"
+			})).Return(&dynamodb.PutItemOutput{}, nil).Once()
+
+			_, err := lambdaHandler(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB, SES: mockSES}, events.APIGatewayV2HTTPRequest{
+				RawPath:               "/subscribe/",
+				QueryStringParameters: map[string]string{"email": "a@example.com"},
+				RequestContext: events.APIGatewayV2HTTPRequestContext{
+					HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{SourceIP: "192.0.2.1"},
+				},
+			})
+
+			assert.NoError(t, err)
+			mockDynamoDB.AssertExpectations(t)
+			mockSES.AssertExpectations(t)
+		})
+	}
+}
+
+func TestAdminHistory(t *testing.T) {
+	os.Setenv("HISTORY_TABLE_NAME", "History")
+	defer os.Unsetenv("HISTORY_TABLE_NAME")
+	os.Setenv("TOMBSTONE_SALT", "pepper")
+	defer os.Unsetenv("TOMBSTONE_SALT")
+
+	db := new(MockDynamoDBClient)
+	db.On("Query", mock.Anything, mock.MatchedBy(func(in *dynamodb.QueryInput) bool {
+		return *in.TableName == "History" &&
+			in.ExpressionAttributeValues[":subscriber"].(*dynamodbtypes.AttributeValueMemberS).Value == saltedEmailHash("a@example.com")
+	})).Return(&dynamodb.QueryOutput{Items: []map[string]dynamodbtypes.AttributeValue{
+		{
+			"subscriber": &dynamodbtypes.AttributeValueMemberS{Value: saltedEmailHash("a@example.com")},
+			"time":       &dynamodbtypes.AttributeValueMemberS{Value: "2024-06-01T12:00:00.000000000Z"},
+			"action":     &dynamodbtypes.AttributeValueMemberS{Value: historySubscribed},
+			"actor":      &dynamodbtypes.AttributeValueMemberS{Value: historyActorSelf},
+			"ip":         &dynamodbtypes.AttributeValueMemberS{Value: "192.0.2.1"},
+		},
+		{
+			"subscriber": &dynamodbtypes.AttributeValueMemberS{Value: saltedEmailHash("a@example.com")},
+			"time":       &dynamodbtypes.AttributeValueMemberS{Value: "2024-06-02T09:30:00.000000000Z"},
+			"action":     &dynamodbtypes.AttributeValueMemberS{Value: historyRemoved},
+			"actor":      &dynamodbtypes.AttributeValueMemberS{Value: historyActorAdmin},
+		},
+	}}, nil).Once()
+
+	var out bytes.Buffer
+	err := runAdmin(context.Background(), &ServiceClients{DynamoDB: db}, []string{"history", "a@example.com"}, &out)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "TIME                            ACTION      ACTOR  IP\n"+
+		"2024-06-01T12:00:00.000000000Z  subscribed  self   192.0.2.1\n"+
+		"2024-06-02T09:30:00.000000000Z  removed     admin  \n", out.String())
+	db.AssertExpectations(t)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+// Column headers that hold the address in each provider's subscriber export.
+var importEmailColumns = map[string][]string{
+	"mailchimp":  {"email address"},
+	"substack":   {"email"},
+	"buttondown": {"email"},
+	"auto":       {"email address", "email", "e-mail", "email_address"},
+}
+
+// importOptions controls how imported addresses are added.
+type importOptions struct {
+	// Add addresses as already confirmed. Otherwise they are added as pending
+	// and sent a confirmation email.
+	Confirmed bool
+	// Confirmation emails sent per second when importing as pending.
+	Rate float64
+	// Report what would happen without writing or sending anything.
+	DryRun bool
+}
+
+// importReport describes the outcome of an import.
+type importReport struct {
+	Rows       int
+	Duplicates int
+	Existing   int
+	OptedOut   int
+	Imported   int
+	Emailed    int
+	Invalid    []invalidImportRow
+}
+
+// invalidImportRow is an address that failed validation.
+type invalidImportRow struct {
+	Line   int
+	Value  string
+	Reason string
+}
+
+// Import subscribers from a provider's CSV export.
+func runImport(ctx context.Context, clients *ServiceClients, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	provider := flags.String("provider", "auto", "format of the export: mailchimp, substack, buttondown, or auto")
+	confirmed := flags.Bool("confirmed", false, "add addresses as already confirmed instead of sending confirmation emails")
+	rate := flags.Float64("rate", 1, "confirmation emails to send per second")
+	dryRun := flags.Bool("dry-run", false, "report what would be imported without changing anything")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: simple-subscribe import [flags] <file.csv>")
+	}
+	if *rate <= 0 {
+		return errors.New("-rate must be greater than zero")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rows, err := readImportCSV(f, *provider)
+	if err != nil {
+		return err
+	}
+	report, err := importSubscribers(ctx, clients, rows, importOptions{Confirmed: *confirmed, Rate: *rate, DryRun: *dryRun})
+	writeImportReport(w, report, *dryRun)
+	return err
+}
+
+// Read the address column from a CSV export, returning one value per data row.
+func readImportCSV(r io.Reader, provider string) ([]string, error) {
+	columns, ok := importEmailColumns[provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q: use mailchimp, substack, buttondown, or auto", provider)
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read CSV header: %w", err)
+	}
+	col := -1
+	for i, name := range header {
+		// Files saved by spreadsheet programs may start with a byte order mark.
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if slices.Contains(columns, name) {
+			col = i
+			break
+		}
+	}
+	if col < 0 {
+		return nil, fmt.Errorf("no email column found in CSV header, looked for %q", columns)
+	}
+
+	var rows []string
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		value := ""
+		if col < len(record) {
+			value = record[col]
+		}
+		rows = append(rows, value)
+	}
+}
+
+// Validate, deduplicate, and add addresses in batches. Addresses already in
+// the table are left as they are, so an import never resets a subscriber's id,
+// and addresses that opted out are skipped.
+func importSubscribers(ctx context.Context, clients *ServiceClients, rows []string, opts importOptions) (importReport, error) {
+	report := importReport{Rows: len(rows)}
+	seen := make(map[string]bool)
+	var emails []string
+	for i, raw := range rows {
+		email, err := parseSubscriberEmail(raw)
+		if err != nil {
+			// Line 1 is the header.
+			report.Invalid = append(report.Invalid, invalidImportRow{Line: i + 2, Value: raw, Reason: err.Error()})
+			continue
+		}
+		if seen[email] {
+			report.Duplicates++
+			continue
+		}
+		seen[email] = true
+		emails = append(emails, email)
+	}
+
+	interval := time.Duration(float64(time.Second) / opts.Rate)
+	var lastSend time.Time
+	for start := 0; start < len(emails); start += maxBatchWriteItems {
+		batch := emails[start:min(start+maxBatchWriteItems, len(emails))]
+		existing, err := existingEmails(ctx, clients.DynamoDB, batch)
+		if err != nil {
+			return report, err
+		}
+		optedOut, err := optedOutEmails(ctx, clients.DynamoDB, batch)
+		if err != nil {
+			return report, err
+		}
+
+		var requests []dynamodbtypes.WriteRequest
+		var added []subscriber
+		for _, email := range batch {
+			if existing[email] {
+				report.Existing++
+				continue
+			}
+			if optedOut[email] {
+				report.OptedOut++
+				continue
+			}
+			now := clock()
+			sub := subscriber{
+				Email:     email,
+				ID:        uuid.New().String(),
+				Confirm:   opts.Confirmed,
+				CreatedAt: formatTime(now),
+				UpdatedAt: formatTime(now),
+			}
+			if opts.Confirmed {
+				sub.ConfirmedAt = sub.CreatedAt
+			} else {
+				sub.ExpiresAt = now.Add(pendingTTL()).Unix()
+			}
+			item, err := attributevalue.MarshalMap(sub)
+			if err != nil {
+				return report, err
+			}
+			requests = append(requests, dynamodbtypes.WriteRequest{PutRequest: &dynamodbtypes.PutRequest{Item: item}})
+			added = append(added, sub)
+		}
+		if opts.DryRun || len(requests) == 0 {
+			report.Imported += len(added)
+			continue
+		}
+		if err := batchWriteItems(ctx, clients.DynamoDB, requests); err != nil {
+			return report, err
+		}
+		report.Imported += len(added)
+		importedEmails := make([]string, len(added))
+		for i, sub := range added {
+			importedEmails[i] = sub.Email
+		}
+		recordHistoryBatch(ctx, clients.DynamoDB, importedEmails, historyImported, historyActorAdmin)
+
+		if opts.Confirmed {
+			continue
+		}
+		for _, sub := range added {
+			// Keep under the SES sending rate.
+			if wait := interval - time.Since(lastSend); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return report, ctx.Err()
+				}
+			}
+			lastSend = time.Now()
+			if _, err := sendEmailWithSES(ctx, clients.SES, sub.Email, sub.ID); err != nil {
+				return report, err
+			}
+			report.Emailed++
+		}
+	}
+	return report, nil
+}
+
+// Report which of up to 100 addresses, or other keys, already have an item in the table.
+func existingEmails(ctx context.Context, svc DynamoDBAPI, emails []string) (map[string]bool, error) {
+	table := os.Getenv("DB_TABLE_NAME")
+	keys := make([]map[string]dynamodbtypes.AttributeValue, len(emails))
+	for i, email := range emails {
+		keys[i] = map[string]dynamodbtypes.AttributeValue{
+			"email": &dynamodbtypes.AttributeValueMemberS{Value: email},
+		}
+	}
+
+	found := make(map[string]bool)
+	request := map[string]dynamodbtypes.KeysAndAttributes{
+		table: {Keys: keys, ProjectionExpression: aws.String("email")},
+	}
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		callCtx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+		callCtx, span := startBackendSpan(callCtx, "DynamoDB", "BatchGetItem")
+		start := time.Now()
+		result, err := svc.BatchGetItem(callCtx, &dynamodb.BatchGetItemInput{RequestItems: request})
+		observeBackend("BatchGetItem", start)
+		if err != nil {
+			recordSpanError(span, err)
+		}
+		span.End()
+		cancel()
+		if err != nil {
+			loggerFrom(ctx).Error("could not get batch", "error", err)
+			return nil, err
+		}
+		for _, item := range result.Responses[table] {
+			if email, ok := item["email"].(*dynamodbtypes.AttributeValueMemberS); ok {
+				found[email.Value] = true
+			}
+		}
+		if len(result.UnprocessedKeys[table].Keys) == 0 {
+			return found, nil
+		}
+		if attempt == 5 {
+			return nil, fmt.Errorf("%d keys unprocessed after %d attempts", len(result.UnprocessedKeys[table].Keys), attempt)
+		}
+		request = result.UnprocessedKeys
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Print a summary of an import, listing any invalid addresses.
+func writeImportReport(w io.Writer, report importReport, dryRun bool) {
+	verb := "imported"
+	if dryRun {
+		verb = "would import"
+	}
+	fmt.Fprintf(w, "rows: %d\n%s: %d\nalready subscribed: %d\nopted out: %d\nduplicates: %d\ninvalid: %d\n",
+		report.Rows, verb, report.Imported, report.Existing, report.OptedOut, report.Duplicates, len(report.Invalid))
+	if report.Emailed > 0 {
+		fmt.Fprintf(w, "confirmation emails sent: %d\n", report.Emailed)
+	}
+	for _, row := range report.Invalid {
+		fmt.Fprintf(w, "  line %d: %q: %s\n", row.Line, row.Value, row.Reason)
+	}
+}
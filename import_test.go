@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestReadImportCSV(t *testing.T) {
+	tests := []struct {
+		name        string
+		provider    string
+		csv         string
+		expected    []string
+		expectedErr string
+	}{
+		{
+			name:     "Mailchimp",
+			provider: "mailchimp",
+			csv:      "Email Address,First Name,MEMBER_RATING\na@example.com,Ann,2\nb@example.com,Bob,3\n",
+			expected: []string{"a@example.com", "b@example.com"},
+		},
+		{
+			name:     "Substack",
+			provider: "substack",
+			csv:      "email,active_subscription,created_at\nc@example.com,false,2023-01-01\n",
+			expected: []string{"c@example.com"},
+		},
+		{
+			name:     "Auto with byte order mark",
+			provider: "auto",
+			csv:      "\ufeffEmail,notes\nd@example.com,\n",
+			expected: []string{"d@example.com"},
+		},
+		{
+			name:        "Missing column",
+			provider:    "buttondown",
+			csv:         "address\ne@example.com\n",
+			expectedErr: "no email column found",
+		},
+		{
+			name:        "Unknown provider",
+			provider:    "carrier-pigeon",
+			csv:         "email\n",
+			expectedErr: "unknown provider",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := readImportCSV(strings.NewReader(tt.csv), tt.provider)
+
+			if tt.expectedErr != "" {
+				assert.ErrorContains(t, err, tt.expectedErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expected, rows)
+			}
+		})
+	}
+}
+
+func TestImportSubscribers(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	rows := []string{"new@example.com", "not-an-email", "existing@example.com", "new@example.com"}
+
+	// Look up existing items, then tombstones, of which there are none.
+	setupGet := func(db *MockDynamoDBClient) {
+		db.On("BatchGetItem", mock.Anything, mock.AnythingOfType("*dynamodb.BatchGetItemInput")).Return(&dynamodb.BatchGetItemOutput{
+			Responses: map[string][]map[string]dynamodbtypes.AttributeValue{
+				"TestTable": {{"email": &dynamodbtypes.AttributeValueMemberS{Value: "existing@example.com"}}},
+			},
+		}, nil).Twice()
+	}
+	putOnly := func(email string, confirm bool) any {
+		return mock.MatchedBy(func(in *dynamodb.BatchWriteItemInput) bool {
+			reqs := in.RequestItems["TestTable"]
+			if len(reqs) != 1 || reqs[0].PutRequest == nil {
+				return false
+			}
+			item := reqs[0].PutRequest.Item
+			_, hasExpiry := item["expires_at"]
+			return item["email"].(*dynamodbtypes.AttributeValueMemberS).Value == email &&
+				item["confirm"].(*dynamodbtypes.AttributeValueMemberBOOL).Value == confirm &&
+				hasExpiry == !confirm
+		})
+	}
+
+	tests := []struct {
+		name           string
+		opts           importOptions
+		setupMocks     func(db *MockDynamoDBClient, mail *MockSESClient)
+		expectedReport importReport
+	}{
+		{
+			name: "Confirmed",
+			opts: importOptions{Confirmed: true, Rate: 1},
+			setupMocks: func(db *MockDynamoDBClient, mail *MockSESClient) {
+				setupGet(db)
+				db.On("BatchWriteItem", mock.Anything, putOnly("new@example.com", true)).Return(&dynamodb.BatchWriteItemOutput{}, nil).Once()
+			},
+			expectedReport: importReport{Rows: 4, Duplicates: 1, Existing: 1, Imported: 1},
+		},
+		{
+			name: "Pending with confirmation emails",
+			opts: importOptions{Rate: 100},
+			setupMocks: func(db *MockDynamoDBClient, mail *MockSESClient) {
+				setupGet(db)
+				db.On("BatchWriteItem", mock.Anything, putOnly("new@example.com", false)).Return(&dynamodb.BatchWriteItemOutput{}, nil).Once()
+				mail.On("SendEmail", mock.Anything, mock.AnythingOfType("*ses.SendEmailInput")).Return(&ses.SendEmailOutput{}, nil).Once()
+			},
+			expectedReport: importReport{Rows: 4, Duplicates: 1, Existing: 1, Imported: 1, Emailed: 1},
+		},
+		{
+			name: "Dry run",
+			opts: importOptions{DryRun: true, Rate: 1},
+			setupMocks: func(db *MockDynamoDBClient, mail *MockSESClient) {
+				setupGet(db)
+			},
+			expectedReport: importReport{Rows: 4, Duplicates: 1, Existing: 1, Imported: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDynamoDB := new(MockDynamoDBClient)
+			mockSES := new(MockSESClient)
+			tt.setupMocks(mockDynamoDB, mockSES)
+
+			report, err := importSubscribers(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB, SES: mockSES}, rows, tt.opts)
+
+			assert.NoError(t, err)
+			assert.Len(t, report.Invalid, 1)
+			assert.Equal(t, 3, report.Invalid[0].Line)
+			report.Invalid = nil
+			assert.Equal(t, tt.expectedReport, report)
+			mockDynamoDB.AssertExpectations(t)
+			mockSES.AssertExpectations(t)
+		})
+	}
+}
+
+func TestExistingEmailsRetriesUnprocessedKeys(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	key := func(email string) map[string]dynamodbtypes.AttributeValue {
+		return map[string]dynamodbtypes.AttributeValue{"email": &dynamodbtypes.AttributeValueMemberS{Value: email}}
+	}
+	unprocessed := map[string]dynamodbtypes.KeysAndAttributes{"TestTable": {Keys: []map[string]dynamodbtypes.AttributeValue{key("b@example.com")}}}
+
+	t.Run("Unprocessed keys are retried", func(t *testing.T) {
+		mockSvc := new(MockDynamoDBClient)
+		mockSvc.On("BatchGetItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.BatchGetItemInput) bool {
+			return len(in.RequestItems["TestTable"].Keys) == 2
+		})).Return(&dynamodb.BatchGetItemOutput{
+			Responses:       map[string][]map[string]dynamodbtypes.AttributeValue{"TestTable": {key("a@example.com")}},
+			UnprocessedKeys: unprocessed,
+		}, nil).Once()
+		mockSvc.On("BatchGetItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.BatchGetItemInput) bool {
+			return len(in.RequestItems["TestTable"].Keys) == 1
+		})).Return(&dynamodb.BatchGetItemOutput{
+			Responses: map[string][]map[string]dynamodbtypes.AttributeValue{"TestTable": {key("b@example.com")}},
+		}, nil).Once()
+
+		found, err := existingEmails(context.Background(), mockSvc, []string{"a@example.com", "b@example.com"})
+
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]bool{"a@example.com": true, "b@example.com": true}, found)
+		mockSvc.AssertExpectations(t)
+	})
+
+	t.Run("Gives up after five attempts", func(t *testing.T) {
+		mockSvc := new(MockDynamoDBClient)
+		mockSvc.On("BatchGetItem", mock.Anything, mock.AnythingOfType("*dynamodb.BatchGetItemInput")).Return(&dynamodb.BatchGetItemOutput{
+			UnprocessedKeys: unprocessed,
+		}, nil).Times(5)
+
+		_, err := existingEmails(context.Background(), mockSvc, []string{"b@example.com"})
+
+		assert.EqualError(t, err, "1 keys unprocessed after 5 attempts")
+		mockSvc.AssertExpectations(t)
+	})
+}
+
+func TestWriteImportReport(t *testing.T) {
+	var out bytes.Buffer
+	writeImportReport(&out, importReport{
+		Rows:     3,
+		Imported: 2,
+		Invalid:  []invalidImportRow{{Line: 4, Value: "nope", Reason: "mail: missing '@' or angle-addr"}},
+	}, true)
+
+	assert.Equal(t, "rows: 3\nwould import: 2\nalready subscribed: 0\nopted out: 0\nduplicates: 0\ninvalid: 1\n"+
+		"  line 4: \"nope\": mail: missing '@' or angle-addr\n", out.String())
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Attribute keys that hold personal data or secrets. Values logged under these
+// keys are hashed or redacted before they are written.
+const (
+	logKeyEmail = "email"
+	logKeyID    = "id"
+	logKeyQuery = "query"
+)
+
+// logger writes structured JSON logs. Lambda forwards stdout to CloudWatch.
+var logger = newLogger(os.Stdout)
+
+type loggerKey struct{}
+
+// Attach a request-scoped logger to ctx.
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// Return the request-scoped logger in ctx, or the package logger if there is none.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// Create a JSON logger at the level given by LOG_LEVEL (debug, info, warn, or error).
+func newLogger(w io.Writer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       logLevel(os.Getenv("LOG_LEVEL")),
+		ReplaceAttr: redactAttr,
+	}))
+}
+
+// Parse a log level name, defaulting to info.
+func logLevel(name string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// Keep email addresses, id tokens, and query strings containing them out of the logs.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	switch a.Key {
+	case logKeyEmail:
+		return slog.String("email_hash", hashEmail(a.Value.String()))
+	case logKeyID:
+		return slog.String(logKeyID, redacted(a.Value.String()))
+	case logKeyQuery:
+		return slog.String(logKeyQuery, redactQuery(a.Value.String()))
+	}
+	return a
+}
+
+// Return a short, stable hash of an email address so log lines for the same
+// subscriber can be correlated without storing the address itself. The hash is
+// keyed with TOMBSTONE_SALT, so it can't be reversed by hashing guesses, and
+// differs from the tombstone and history keys. Without the salt, the address
+// is redacted.
+func hashEmail(email string) string {
+	if email == "" {
+		return ""
+	}
+	salt := os.Getenv("TOMBSTONE_SALT")
+	if salt == "" {
+		return redacted(email)
+	}
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte("log:" + strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// Replace a secret value with a placeholder, preserving whether it was empty.
+func redacted(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "[REDACTED]"
+}
+
+// Hash the email and redact the id in a raw query string.
+func redactQuery(raw string) string {
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		return redacted(raw)
+	}
+	for key := range values {
+		switch key {
+		case logKeyEmail:
+			values.Set(key, hashEmail(values.Get(key)))
+		case logKeyID:
+			values.Set(key, redacted(values.Get(key)))
+		}
+	}
+	return values.Encode()
+}
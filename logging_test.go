@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogLevel(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected slog.Level
+	}{
+		{name: "Empty defaults to info", input: "", expected: slog.LevelInfo},
+		{name: "Debug", input: "debug", expected: slog.LevelDebug},
+		{name: "Upper case warn", input: "WARN", expected: slog.LevelWarn},
+		{name: "Error", input: "error", expected: slog.LevelError},
+		{name: "Unknown defaults to info", input: "verbose", expected: slog.LevelInfo},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, logLevel(tt.input))
+		})
+	}
+}
+
+func TestHashEmail(t *testing.T) {
+	os.Setenv("TOMBSTONE_SALT", "pepper")
+	defer os.Unsetenv("TOMBSTONE_SALT")
+	hash := hashEmail("test@example.com")
+
+	assert.Len(t, hash, 16)
+	assert.Equal(t, hash, hashEmail(" Test@Example.com "))
+	assert.NotEqual(t, hash, hashEmail("other@example.com"))
+	assert.NotContains(t, saltedEmailHash("test@example.com"), hash)
+
+	// A different salt gives a different hash, so it can't be looked up.
+	os.Setenv("TOMBSTONE_SALT", "salt")
+	assert.NotEqual(t, hash, hashEmail("test@example.com"))
+
+	os.Unsetenv("TOMBSTONE_SALT")
+	assert.Equal(t, "[REDACTED]", hashEmail("test@example.com"))
+	assert.Equal(t, "", hashEmail(""))
+}
+
+func TestRedactQuery(t *testing.T) {
+	os.Setenv("TOMBSTONE_SALT", "pepper")
+	defer os.Unsetenv("TOMBSTONE_SALT")
+	tests := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{
+			name:     "Email and id",
+			raw:      "email=test@example.com&id=123",
+			expected: "email=" + hashEmail("test@example.com") + "&id=%5BREDACTED%5D",
+		},
+		{
+			name:     "Other parameters are kept",
+			raw:      "source=footer",
+			expected: "source=footer",
+		},
+		{
+			name:     "Empty",
+			raw:      "",
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, redactQuery(tt.raw))
+		})
+	}
+}
+
+func TestNewLoggerRedactsPersonalData(t *testing.T) {
+	os.Setenv("LOG_LEVEL", "debug")
+	defer os.Unsetenv("LOG_LEVEL")
+	os.Setenv("TOMBSTONE_SALT", "pepper")
+	defer os.Unsetenv("TOMBSTONE_SALT")
+
+	var buf bytes.Buffer
+	newLogger(&buf).Debug("test", logKeyEmail, "Test@Example.com", logKeyID, "secret-id", logKeyQuery, "email=test@example.com&id=secret-id")
+
+	assert.NotContains(t, buf.String(), "example.com")
+	assert.NotContains(t, buf.String(), "secret-id")
+
+	var line map[string]any
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, hashEmail("test@example.com"), line["email_hash"])
+	assert.Equal(t, "[REDACTED]", line[logKeyID])
+}
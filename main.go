@@ -2,74 +2,173 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
+	"net"
 	"net/http"
 	"net/mail"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
 	"github.com/aws/aws-sdk-go-v2/service/ses"
 	sestypes "github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Define interfaces for AWS service clients to enable mocking.
-// The concrete v2 clients (*dynamodb.Client, *ses.Client) satisfy these.
+// The concrete v2 clients (*dynamodb.Client, *ses.Client, etc.) satisfy these.
 type DynamoDBAPI interface {
 	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
 	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
 	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+	BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error)
+	BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
 }
 
 type SESAPI interface {
 	SendEmail(ctx context.Context, params *ses.SendEmailInput, optFns ...func(*ses.Options)) (*ses.SendEmailOutput, error)
+	GetSendQuota(ctx context.Context, params *ses.GetSendQuotaInput, optFns ...func(*ses.Options)) (*ses.GetSendQuotaOutput, error)
+}
+
+type SNSAPI interface {
+	Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+}
+
+type EventBridgeAPI interface {
+	PutEvents(ctx context.Context, params *eventbridge.PutEventsInput, optFns ...func(*eventbridge.Options)) (*eventbridge.PutEventsOutput, error)
 }
 
 // ServiceClients holds the AWS service clients
 type ServiceClients struct {
-	DynamoDB DynamoDBAPI
-	SES      SESAPI
+	DynamoDB    DynamoDBAPI
+	SES         SESAPI
+	SNS         SNSAPI
+	EventBridge EventBridgeAPI
+	Resolver    Resolver
 }
 
-// Determine if an email exists with the given id.
-func emailExistsWithId(svc DynamoDBAPI, email string, id string) (bool, error) {
-	table := os.Getenv("DB_TABLE_NAME")
-	input := &dynamodb.GetItemInput{
-		// Get an item that matches email
-		Key: map[string]dynamodbtypes.AttributeValue{
-			"email": &dynamodbtypes.AttributeValueMemberS{Value: email},
-		},
-		TableName: aws.String(table),
+// Layout of the legacy timestamp attribute. Times are in the Lambda's zone, UTC.
+const timestampLayout = "2006-01-02 15:04:05"
+
+// clock tells the time saved on items and in their history. Tests replace it.
+var clock = time.Now
+
+// Format a time for the created_at, confirmed_at, and updated_at attributes.
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// How long a subscription request stays pending before DynamoDB's TTL removes it.
+const defaultPendingTTL = 7 * 24 * time.Hour
+
+// Default limits for a single call to each AWS service. Keeping these well under
+// the Lambda timeout means one slow dependency can't use up the whole invocation.
+const (
+	defaultDBTimeout  = 3 * time.Second
+	defaultSESTimeout = 5 * time.Second
+)
+
+// Derive a context for one AWS call, bounded by the duration in the named
+// environment variable (e.g. "2s") or def if it is unset or invalid.
+// The parent's deadline still applies if it is sooner.
+func withTimeout(ctx context.Context, key string, def time.Duration) (context.Context, context.CancelFunc) {
+	timeout := def
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		timeout = d
 	}
+	return context.WithTimeout(ctx, timeout)
+}
 
-	result, err := svc.GetItem(context.Background(), input)
+// Parse and validate an address given by a would-be subscriber, returning the
+// normalized address. Every path that adds subscribers uses this, before
+// anything is saved or sent.
+func parseSubscriberEmail(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	addr, err := mail.ParseAddress(raw)
+	if err != nil {
+		return "", err
+	}
+	bare, err := bareAddress(raw, addr)
+	if err != nil {
+		return "", err
+	}
+	email, err := normalizeEmail(bare)
+	if err != nil {
+		return "", err
+	}
+	if err := checkEmail(email); err != nil {
+		return "", err
+	}
+	return email, nil
+}
+
+// Find the item for an address given in a link and report whether its id
+// matches, returning the item's key. Items saved before addresses were
+// normalized are keyed by the address as it was given, so that is tried when
+// the normalized address has no match.
+func matchEmailWithId(ctx context.Context, svc DynamoDBAPI, raw string, id string) (string, bool, error) {
+	if email, err := parseSubscriberEmail(raw); err == nil {
+		match, err := emailExistsWithId(ctx, svc, email, id)
+		if match || err != nil || email == raw {
+			return email, match, err
+		}
+	}
+	match, err := emailExistsWithId(ctx, svc, raw, id)
+	return raw, match, err
+}
+
+// Determine if an email exists with the given id.
+func emailExistsWithId(ctx context.Context, svc DynamoDBAPI, email string, id string) (bool, error) {
+	sub, err := getSubscriber(ctx, svc, email)
 	if err != nil {
-		log.Print(err.Error())
 		return false, err
 	}
-	if result.Item == nil {
+	if sub == nil {
 		return false, nil
 	}
 	// Double check that the resulting email and id matches the input, return emailExistsWithId == true
-	emailAttr, emailOk := result.Item["email"].(*dynamodbtypes.AttributeValueMemberS)
-	idAttr, idOk := result.Item["id"].(*dynamodbtypes.AttributeValueMemberS)
-	if emailOk && idOk && emailAttr.Value == email && idAttr.Value == id {
+	if sub.Email == email && sub.ID == id {
+		// DynamoDB can take a while to remove items after their TTL passes,
+		// so treat an expired pending item as already gone.
+		if sub.expired(clock()) {
+			loggerFrom(ctx).Info("pending item has expired", logKeyEmail, email)
+			return false, nil
+		}
 		return true, nil
 	}
-	log.Printf("No match for email: %s with id: %s", email, id)
+	loggerFrom(ctx).Info("no match for email and id", logKeyEmail, email, logKeyID, id)
 	return false, nil
 }
 
-// Edits an existing email's attributes. No authorization is performed here, so ensure you check that values of email and id match before calling this function.
-func updateItemInDynamoDB(svc DynamoDBAPI, email string, id string, timestamp string, confirm bool) (*dynamodb.UpdateItemOutput, error) {
+// Read how long a pending subscription is kept from PENDING_TTL, e.g. "72h".
+func pendingTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("PENDING_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultPendingTTL
+}
+
+// Edits an existing email's attributes, as of now. No authorization is performed here, so ensure you check that values of email and id match before calling this function.
+func updateItemInDynamoDB(ctx context.Context, svc DynamoDBAPI, email string, id string, now time.Time, confirm bool, fields map[string]string, consent *consentRecord) (*dynamodb.UpdateItemOutput, error) {
 	table := os.Getenv("DB_TABLE_NAME")
 
 	input := &dynamodb.UpdateItemInput{
@@ -81,53 +180,185 @@ func updateItemInDynamoDB(svc DynamoDBAPI, email string, id string, timestamp st
 		// Give the keys to be updated a shorthand to reference
 		ExpressionAttributeNames: map[string]string{
 			"#ID": "id",
-			"#T":  "timestamp",
 			"#C":  "confirm",
+			"#E":  "expires_at",
+			"#CA": "created_at",
+			"#CF": "confirmed_at",
+			"#U":  "updated_at",
+			"#RC": "resend_count",
+			"#RA": "resent_at",
 		},
 		// Give the incoming values a shorthand to reference
 		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
 			":idval":      &dynamodbtypes.AttributeValueMemberS{Value: id},
-			":timeval":    &dynamodbtypes.AttributeValueMemberS{Value: timestamp},
+			":nowval":     &dynamodbtypes.AttributeValueMemberS{Value: formatTime(now)},
 			":confirmval": &dynamodbtypes.AttributeValueMemberBOOL{Value: confirm},
 		},
-		// Use the shorthand references to update these keys
-		UpdateExpression: aws.String("SET #C = :confirmval, #T = :timeval, #ID = :idval"),
-		TableName:        aws.String(table),
+		// Return the item as it was, so callers can tell a new subscriber from a returning one.
+		ReturnValues: dynamodbtypes.ReturnValueAllOld,
+		TableName:    aws.String(table),
 	}
-
-	result, err := svc.UpdateItem(context.Background(), input)
+	// Use the shorthand references to update these keys. The first request
+	// and first confirmation keep their times.
+	set := "SET #C = :confirmval, #U = :nowval, #CA = if_not_exists(#CA, :nowval), #ID = :idval"
+	var remove []string
+	if !confirm {
+		// Let DynamoDB's TTL delete the request if it is never confirmed.
+		expiresAt := now.Add(pendingTTL()).Unix()
+		input.ExpressionAttributeValues[":expval"] = &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt, 10)}
+		set += ", #E = :expval"
+		remove = append(remove, "#CF")
+	}
+	// Custom fields are only replaced when new ones are given.
+	if len(fields) > 0 {
+		av, err := attributevalue.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		input.ExpressionAttributeNames["#F"] = "fields"
+		input.ExpressionAttributeValues[":fieldsval"] = av
+		set += ", #F = :fieldsval"
+	}
+	// Consent given when subscribing is kept apart from consent given when
+	// verifying, so both can be shown.
+	if consent != nil {
+		av, err := attributevalue.Marshal(consent)
+		if err != nil {
+			return nil, err
+		}
+		input.ExpressionAttributeNames["#CR"] = "subscribe_consent"
+		if confirm {
+			input.ExpressionAttributeNames["#CR"] = "verify_consent"
+		}
+		input.ExpressionAttributeValues[":consentval"] = av
+		if confirm {
+			// Keep the evidence from the click that confirmed, not from later
+			// clicks or link scanners.
+			set += ", #CR = if_not_exists(#CR, :consentval)"
+		} else {
+			set += ", #CR = :consentval"
+		}
+	}
+	if confirm {
+		set += ", #CF = if_not_exists(#CF, :nowval)"
+		// Confirmed subscribers are kept, so they have no expiry.
+		remove = append(remove, "#E")
+	}
+	// A new request or a confirmation starts the resend limit over.
+	remove = append(remove, "#RC", "#RA")
+	input.UpdateExpression = aws.String(set + " REMOVE " + strings.Join(remove, ", "))
+
+	ctx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "DynamoDB", "UpdateItem")
+	defer span.End()
+	defer observeBackend("UpdateItem", time.Now())
+	result, err := svc.UpdateItem(ctx, input)
 	if err != nil {
-		log.Print(err.Error())
+		recordSpanError(span, err)
+		loggerFrom(ctx).Error("could not update item", "error", err)
+		return result, err
 	}
-	return result, err
+	// An item that hasn't been migrated keeps its times in the legacy
+	// timestamp, so save those rather than now.
+	return result, keepLegacyTimes(ctx, svc, email, confirm, result.Attributes)
 }
 
-// Delete an email from the table if the id matches.
-func deleteEmailFromDynamoDb(svc DynamoDBAPI, email string, id string) (*dynamodb.DeleteItemOutput, error) {
+// Report whether an item, as returned by updateItemInDynamoDB, had already
+// confirmed.
+func wasConfirmed(item map[string]dynamodbtypes.AttributeValue) bool {
+	confirm, ok := item["confirm"].(*dynamodbtypes.AttributeValueMemberBOOL)
+	return ok && confirm.Value
+}
+
+// Delete an email from the table if the id matches, and leave a tombstone to
+// record the opt-out. Both happen in one transaction, so a subscriber is never
+// gone without their opt-out being kept.
+func deleteEmailFromDynamoDb(ctx context.Context, svc DynamoDBAPI, email string, id string) (*dynamodb.TransactWriteItemsOutput, error) {
 	table := os.Getenv("DB_TABLE_NAME")
-	input := &dynamodb.DeleteItemInput{
-		Key: map[string]dynamodbtypes.AttributeValue{
-			"email": &dynamodbtypes.AttributeValueMemberS{Value: email},
-		},
-		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
-			":emailval": &dynamodbtypes.AttributeValueMemberS{Value: email},
-			":idval":    &dynamodbtypes.AttributeValueMemberS{Value: id},
+	input := &dynamodb.TransactWriteItemsInput{
+		TransactItems: []dynamodbtypes.TransactWriteItem{
+			{Delete: &dynamodbtypes.Delete{
+				Key: map[string]dynamodbtypes.AttributeValue{
+					"email": &dynamodbtypes.AttributeValueMemberS{Value: email},
+				},
+				ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+					":emailval": &dynamodbtypes.AttributeValueMemberS{Value: email},
+					":idval":    &dynamodbtypes.AttributeValueMemberS{Value: id},
+				},
+				// Find an item that matches both email and id
+				ConditionExpression: aws.String("email = :emailval AND id = :idval"),
+				TableName:           aws.String(table),
+			}},
+			{Put: &dynamodbtypes.Put{
+				Item:      tombstoneItem(email, clock()),
+				TableName: aws.String(table),
+			}},
 		},
-		// Find an item that matches both email and id
-		ConditionExpression: aws.String("email = :emailval AND id = :idval"),
-		TableName:           aws.String(table),
 	}
 
-	result, err := svc.DeleteItem(context.Background(), input)
+	ctx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "DynamoDB", "TransactWriteItems")
+	defer span.End()
+	defer observeBackend("TransactWriteItems", time.Now())
+	result, err := svc.TransactWriteItems(ctx, input)
 	if err != nil {
-		log.Println(err.Error())
+		recordSpanError(span, err)
+		loggerFrom(ctx).Error("could not delete item", "error", err)
+		return result, err
+	}
+	return result, nil
+}
+
+// The most write requests a single BatchWriteItem call accepts.
+const maxBatchWriteItems = 25
+
+// Write up to maxBatchWriteItems requests to the table, retrying any that
+// DynamoDB returns as unprocessed with exponential backoff.
+func batchWriteItems(ctx context.Context, svc DynamoDBAPI, requests []dynamodbtypes.WriteRequest) error {
+	return batchWriteTable(ctx, svc, os.Getenv("DB_TABLE_NAME"), requests)
+}
+
+// Write up to 25 requests to the named table, as batchWriteItems does.
+func batchWriteTable(ctx context.Context, svc DynamoDBAPI, table string, requests []dynamodbtypes.WriteRequest) error {
+	pending := map[string][]dynamodbtypes.WriteRequest{table: requests}
+	backoff := 100 * time.Millisecond
+
+	for attempt := 1; ; attempt++ {
+		callCtx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+		callCtx, span := startBackendSpan(callCtx, "DynamoDB", "BatchWriteItem")
+		start := time.Now()
+		result, err := svc.BatchWriteItem(callCtx, &dynamodb.BatchWriteItemInput{RequestItems: pending})
+		observeBackend("BatchWriteItem", start)
+		if err != nil {
+			recordSpanError(span, err)
+		}
+		span.End()
+		cancel()
+		if err != nil {
+			loggerFrom(ctx).Error("could not write batch", "error", err)
+			return err
+		}
+		if len(result.UnprocessedItems[table]) == 0 {
+			return nil
+		}
+		if attempt == 5 {
+			return fmt.Errorf("%d items unprocessed after %d attempts", len(result.UnprocessedItems[table]), attempt)
+		}
+		pending = result.UnprocessedItems
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
-	return result, err
 }
 
 // Send a confirmation email with a link to complete subscription.
-func sendEmailWithSES(sesSvc SESAPI, email string, id string) (*ses.SendEmailOutput, error) {
-	log.Print("EMAIL: ", email)
+func sendEmailWithSES(ctx context.Context, sesSvc SESAPI, email string, id string) (*ses.SendEmailOutput, error) {
+	loggerFrom(ctx).Debug("sending confirmation email", logKeyEmail, email)
 
 	// HTML format
 	msg := fmt.Sprintf("<p>Hello! You're receiving this email because you requested a subscription to my list.</p><p>To complete your subscription, please click this link to finish signing up:</p><p><a class=\"ulink\" href=\"%s%s/?email=%s&id=%s\" target=\"_blank\">Confirm subscription</a>.</p><p>If you did not request this email, you can safely ignore it. Your email address has not yet been added to my list.</p>", os.Getenv("API_URL"), os.Getenv("VERIFY_PATH"), email, id)
@@ -135,6 +366,17 @@ func sendEmailWithSES(sesSvc SESAPI, email string, id string) (*ses.SendEmailOut
 	// Plain text format
 	txt := fmt.Sprintf("Hello! You're receiving this email because you requested a subscription to my list.\n\nTo complete your subscription, please visit this link to finish signing up.\n\n%s%s/?email=%s&id=%s\n\nIf you did not request this email, you can safely ignore it. Your email address has not yet been added to my list.", os.Getenv("API_URL"), os.Getenv("VERIFY_PATH"), email, id)
 
+	return sendMessageWithSES(ctx, sesSvc, email, "Confirm your subscription", msg, txt)
+}
+
+// Build the link a subscriber can visit to unsubscribe.
+func unsubscribeURL(email string, id string) string {
+	query := url.Values{"email": {email}, "id": {id}}
+	return fmt.Sprintf("%s%s/?%s", os.Getenv("API_URL"), os.Getenv("UNSUBSCRIBE_PATH"), query.Encode())
+}
+
+// Send one message to one recipient from SENDER_NAME and SENDER_EMAIL.
+func sendMessageWithSES(ctx context.Context, sesSvc SESAPI, email string, subject string, html string, text string) (*ses.SendEmailOutput, error) {
 	// Build the "from" value
 	source := fmt.Sprintf("\"%s\" <%s>", os.Getenv("SENDER_NAME"), os.Getenv("SENDER_EMAIL"))
 
@@ -146,69 +388,234 @@ func sendEmailWithSES(sesSvc SESAPI, email string, id string) (*ses.SendEmailOut
 			Body: &sestypes.Body{
 				Html: &sestypes.Content{
 					Charset: aws.String("UTF-8"),
-					Data:    aws.String(msg),
+					Data:    aws.String(html),
 				},
 				Text: &sestypes.Content{
 					Charset: aws.String("UTF-8"),
-					Data:    aws.String(txt),
+					Data:    aws.String(text),
 				},
 			},
 			Subject: &sestypes.Content{
 				Charset: aws.String("UTF-8"),
-				Data:    aws.String("Confirm your subscription"),
+				Data:    aws.String(subject),
 			},
 		},
 		ReturnPath: aws.String(os.Getenv("SENDER_EMAIL")),
 		Source:     aws.String(source),
 	}
 
-	result, err := sesSvc.SendEmail(context.Background(), input)
+	ctx, cancel := withTimeout(ctx, "SES_TIMEOUT", defaultSESTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "SES", "SendEmail")
+	defer span.End()
+	defer observeBackend("SendEmail", time.Now())
+	result, err := sesSvc.SendEmail(ctx, input)
 	if err != nil {
-		log.Print(err.Error())
+		recordSpanError(span, err)
+		loggerFrom(ctx).Error("could not send email", "error", err)
 		return result, err
 	}
-	log.Print(result)
+	loggerFrom(ctx).Debug("sent email", "message_id", aws.ToString(result.MessageId))
 	return result, nil
 }
 
-func lambdaHandler(ctx context.Context, clients *ServiceClients, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+// Name the action a request path maps to, for logging.
+func actionForPath(path string) string {
+	switch path {
+	case fmt.Sprintf("/%s/", os.Getenv("SUBSCRIBE_PATH")):
+		return "subscribe"
+	case fmt.Sprintf("/%s/", os.Getenv("VERIFY_PATH")):
+		return "verify"
+	case fmt.Sprintf("/%s/", os.Getenv("UNSUBSCRIBE_PATH")):
+		return "unsubscribe"
+	case fmt.Sprintf("/%s/", os.Getenv("DATA_REQUEST_PATH")):
+		return "data_request"
+	case fmt.Sprintf("/%s/", os.Getenv("RESEND_PATH")):
+		return "resend"
+	}
+	return "unknown"
+}
+
+func lambdaHandler(ctx context.Context, clients *ServiceClients, event events.APIGatewayV2HTTPRequest) (resp events.APIGatewayV2HTTPResponse, err error) {
 
 	errorPage := fmt.Sprintf("%s%s", os.Getenv("BASE_URL"), os.Getenv("ERROR_PAGE"))
 	successPage := fmt.Sprintf("%s%s", os.Getenv("BASE_URL"), os.Getenv("SUCCESS_PAGE"))
 	confirmSubscribe := fmt.Sprintf("%s%s", os.Getenv("BASE_URL"), os.Getenv("CONFIRM_SUBSCRIBE_PAGE"))
 	confirmUnsubscribe := fmt.Sprintf("%s%s", os.Getenv("BASE_URL"), os.Getenv("CONFIRM_UNSUBSCRIBE_PAGE"))
-	resp := events.APIGatewayV2HTTPResponse{Headers: make(map[string]string)}
+	confirmResend := fmt.Sprintf("%s%s", os.Getenv("BASE_URL"), envOrDefault("CONFIRM_RESEND_PAGE", os.Getenv("CONFIRM_SUBSCRIBE_PAGE")))
+	confirmDataRequest := fmt.Sprintf("%s%s", os.Getenv("BASE_URL"), envOrDefault("CONFIRM_DATA_REQUEST_PAGE", os.Getenv("SUCCESS_PAGE")))
+	resp = events.APIGatewayV2HTTPResponse{Headers: make(map[string]string)}
 	resp.Headers["Access-Control-Allow-Origin"] = "*"
 	resp.StatusCode = http.StatusSeeOther
 
+	// Log and trace one line per request with its outcome and latency.
+	start := time.Now()
+	action := actionForPath(event.RawPath)
+	log := logger.With(
+		slog.String("request_id", event.RequestContext.RequestID),
+		slog.String("action", action),
+	)
+	ctx = withLogger(ctx, log)
+	ctx, span := startSpan(ctx, "lambdaHandler",
+		attribute.String("http.route", event.RawPath),
+		attribute.String("faas.invocation_id", event.RequestContext.RequestID),
+		attribute.String("simple_subscribe.action", action),
+	)
+	defer span.End()
+	defer func() {
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+			recordSpanError(span, err)
+		} else if resp.Headers["Location"] == errorPage || resp.StatusCode == http.StatusUnprocessableEntity {
+			outcome = "rejected"
+		}
+		span.SetAttributes(attribute.String("simple_subscribe.outcome", outcome))
+		log.Info("request complete",
+			slog.String("outcome", outcome),
+			slog.Int64("latency_ms", time.Since(start).Milliseconds()),
+		)
+	}()
+
 	// Request a new subscription.
 	if event.RawPath == fmt.Sprintf("/%s/", os.Getenv("SUBSCRIBE_PATH")) {
+		metrics.Count(metricSubscribeRequests, nil)
 		// Parse email from query string
-		email, err := mail.ParseAddress(event.QueryStringParameters["email"])
+		email, err := parseSubscriberEmail(event.QueryStringParameters["email"])
 		if err != nil {
-			log.Print("Could not get email: ", err)
+			log.Warn("could not get email", "error", err)
+			countError("invalid_email")
 			resp.Headers["Location"] = errorPage
 			return resp, err
 		}
 
-		// Add requested email, new id, timestamp, and confirm == false to the table.
+		// Drop throwaway and role addresses without saying so, so the lists
+		// can't be probed.
+		if reason, blocked := blockedSignup(email); blocked {
+			log.Info("ignoring subscribe request from a blocked address", "reason", reason, logKeyEmail, email)
+			metrics.Count(metricBlockedSignups, map[string]string{"Reason": reason})
+			resp.Headers["Location"] = confirmSubscribe
+			return resp, nil
+		}
+
+		// Don't spend a send on a domain that takes no mail. If DNS can't
+		// answer, let the request through.
+		if domainCheckEnabled() {
+			domain := email[strings.LastIndex(email, "@")+1:]
+			deliverable, err := domainDeliverable(ctx, clients.resolver(), domain)
+			if err != nil {
+				log.Warn("could not check email domain", "error", err)
+			} else if !deliverable {
+				log.Info("rejecting subscribe request for a domain that takes no mail", logKeyEmail, email)
+				countError("undeliverable_domain")
+				if acceptsJSON(event) {
+					resp.StatusCode = http.StatusUnprocessableEntity
+					resp.Headers["Content-Type"] = "application/json"
+					resp.Body = undeliverableJSON(email)
+					return resp, nil
+				}
+				resp.Headers["Location"] = errorPage
+				return resp, nil
+			}
+		}
+
+		// Only accept the custom fields that are configured, within their limits.
+		specs, err := subscriberFieldSpecs()
+		if err != nil {
+			log.Error("could not read custom field configuration", "error", err)
+			countError("invalid_fields")
+			resp.Headers["Location"] = errorPage
+			return resp, err
+		}
+		fields, err := parseSubscriberFields(specs, event.QueryStringParameters)
+		if err != nil {
+			log.Warn("could not get custom fields", "error", err)
+			countError("invalid_fields")
+			resp.Headers["Location"] = errorPage
+			return resp, err
+		}
+
+		// A repeat request while the link is still good sends the same link
+		// again, with the same cooldown and limit as RESEND_PATH.
+		existing, gerr := getSubscriber(ctx, clients.DynamoDB, email)
+		if gerr != nil {
+			log.Error("could not read database", "error", gerr)
+			countError("database")
+			resp.Headers["Location"] = errorPage
+			return resp, gerr
+		}
+		now := clock()
+		if awaitingConfirmation(existing, now) {
+			sent, rerr := resendToPending(ctx, clients, existing, now)
+			if rerr != nil {
+				log.Error("could not resend confirmation email", "error", rerr)
+				countError("resend")
+				resp.Headers["Location"] = errorPage
+				return resp, rerr
+			}
+			if sent {
+				metrics.Count(metricResends, nil)
+				metrics.Count(metricConfirmationEmailsSent, nil)
+			} else {
+				log.Info("not resending confirmation email", logKeyEmail, email)
+			}
+			resp.Headers["Location"] = confirmSubscribe
+			return resp, nil
+		}
+
+		// Anyone can submit the form for any address, so it must not turn a
+		// confirmed subscriber back into a pending request that expires.
+		if existing != nil && existing.Confirm {
+			log.Info("ignoring subscribe request from a confirmed subscriber", logKeyEmail, email)
+			resp.Headers["Location"] = confirmSubscribe
+			return resp, nil
+		}
+
+		// Honor opt-outs, unless people may opt back in by confirming again.
+		// Send the requester to the usual page so this can't be used to learn
+		// who has left the list.
+		if !resubscribeAfterOptOut() {
+			optedOut, err := hasTombstone(ctx, clients.DynamoDB, email)
+			if err != nil {
+				log.Error("could not check for an opt-out", "error", err)
+				countError("database")
+				resp.Headers["Location"] = errorPage
+				return resp, err
+			}
+			if optedOut {
+				log.Info("ignoring subscribe request from an address that opted out", logKeyEmail, email)
+				resp.Headers["Location"] = confirmSubscribe
+				return resp, nil
+			}
+		}
+
+		// Add requested email, new id, times, confirm == false, and any custom fields to the table.
 		id := uuid.New().String()
-		timestamp := time.Now().Format("2006-01-02 15:04:05")
-		_, uerr := updateItemInDynamoDB(clients.DynamoDB, email.Address, id, timestamp, false)
+		previous, uerr := updateItemInDynamoDB(ctx, clients.DynamoDB, email, id, now, false, fields, consentFromEvent(event, now))
 		if uerr != nil {
-			log.Print("Could not update database: ", uerr)
+			log.Error("could not update database", "error", uerr)
+			countError("database")
 			resp.Headers["Location"] = errorPage
 			return resp, uerr
 		}
 
 		// Send confirmation email.
-		_, serr := sendEmailWithSES(clients.SES, email.Address, id)
+		_, serr := sendEmailWithSES(ctx, clients.SES, email, id)
 		if serr != nil {
-			log.Print("Could not send confirmation email: ", serr)
+			log.Error("could not send confirmation email", "error", serr)
+			countError("email")
 			resp.Headers["Location"] = errorPage
 			return resp, serr
 		}
 
+		metrics.Count(metricConfirmationEmailsSent, nil)
+		change := historySubscribed
+		if len(previous.Attributes) > 0 {
+			change = historyResubscribed
+		}
+		recordHistory(ctx, clients.DynamoDB, email, change, historyActorSelf, event.RequestContext.HTTP.SourceIP)
+		emitWebhookEvent(ctx, clients.DynamoDB, webhookSubscriberPending, email)
+
 		// Sends requester to the SUCCESS_PATH in all cases that do not result in an error.
 		// This mitigates enumeration.
 		resp.Headers["Location"] = confirmSubscribe
@@ -219,32 +626,52 @@ func lambdaHandler(ctx context.Context, clients *ServiceClients, event events.AP
 	// Verify a subscription and add email to list.
 	if event.RawPath == fmt.Sprintf("/%s/", os.Getenv("VERIFY_PATH")) {
 		// Parse email and id from query string.
-		email, emailpresent := event.QueryStringParameters["email"]
+		rawEmail, emailpresent := event.QueryStringParameters["email"]
 		id, idpresent := event.QueryStringParameters["id"]
 		if (emailpresent == false) || (idpresent == false) {
-			log.Printf("Missing parameters in query string: %s", event.RawQueryString)
+			log.Warn("missing parameters in query string", logKeyQuery, event.RawQueryString)
+			countError("missing_parameters")
 			resp.Headers["Location"] = errorPage
 			return resp, nil
 		}
 
 		// Query for matching item. Both email and id must match.
-		match, err := emailExistsWithId(clients.DynamoDB, email, id)
+		email, match, err := matchEmailWithId(ctx, clients.DynamoDB, rawEmail, id)
 
 		if match == true {
-			// Set confirm == true and update timestamp for when they subscribed.
-			timestamp := time.Now().Format("2006-01-02 15:04:05")
-			_, uerr := updateItemInDynamoDB(clients.DynamoDB, email, id, timestamp, true)
+			// Set confirm == true and record when they confirmed.
+			now := clock()
+			previous, uerr := updateItemInDynamoDB(ctx, clients.DynamoDB, email, id, now, true, nil, consentFromEvent(event, now))
 			if uerr != nil {
-				log.Printf("Could not update item in database: %s\n with query string: %s", uerr, event.RawQueryString)
+				log.Error("could not update item in database", "error", uerr, logKeyQuery, event.RawQueryString)
+				countError("database")
 				resp.Headers["Location"] = errorPage
 				return resp, uerr
 			}
+			// A second click, or a scanner following the link, confirms
+			// nothing new, so it isn't recorded or announced again.
+			if wasConfirmed(previous.Attributes) {
+				log.Info("subscriber had already confirmed", logKeyEmail, email)
+				resp.Headers["Location"] = successPage
+				return resp, nil
+			}
+			metrics.Count(metricVerifications, nil)
+			recordHistory(ctx, clients.DynamoDB, email, historyConfirmed, historyActorSelf, event.RequestContext.HTTP.SourceIP)
+			// Confirming is a new opt-in, so it replaces any earlier opt-out.
+			if cleared, err := deleteTombstone(ctx, clients.DynamoDB, email); err != nil {
+				countError("database")
+			} else if cleared {
+				recordHistory(ctx, clients.DynamoDB, email, historyOptOutCleared, historyActorSelf, event.RequestContext.HTTP.SourceIP)
+			}
+			notifyOwner(ctx, ownerEventConfirmed, email)
+			emitWebhookEvent(ctx, clients.DynamoDB, webhookSubscriberConfirmed, email)
 			resp.Headers["Location"] = successPage
 			return resp, nil
 		}
 		// If details don't match, return error.
 		if err != nil {
-			log.Printf("Received a bad confirmation request: %s", event.RawQueryString)
+			log.Warn("received a bad confirmation request", "error", err, logKeyQuery, event.RawQueryString)
+			countError("database")
 			resp.Headers["Location"] = errorPage
 			return resp, err
 		}
@@ -253,36 +680,107 @@ func lambdaHandler(ctx context.Context, clients *ServiceClients, event events.AP
 	// Delete an item from the list. Both email and id must match.
 	if event.RawPath == fmt.Sprintf("/%s/", os.Getenv("UNSUBSCRIBE_PATH")) {
 		// Parse email and id from query string.
-		email, emailpresent := event.QueryStringParameters["email"]
+		rawEmail, emailpresent := event.QueryStringParameters["email"]
 		id, idpresent := event.QueryStringParameters["id"]
 		if (emailpresent == false) || (idpresent == false) {
-			log.Printf("Missing parameters in query string: %s", event.RawQueryString)
+			log.Warn("missing parameters in query string", logKeyQuery, event.RawQueryString)
+			countError("missing_parameters")
 			resp.Headers["Location"] = errorPage
 			return resp, nil
 		}
 		// Try to find a match
-		match, err := emailExistsWithId(clients.DynamoDB, email, id)
+		email, match, err := matchEmailWithId(ctx, clients.DynamoDB, rawEmail, id)
 		if match == true {
 			// There's a matching item, so try to delete it
-			_, derr := deleteEmailFromDynamoDb(clients.DynamoDB, email, id)
+			_, derr := deleteEmailFromDynamoDb(ctx, clients.DynamoDB, email, id)
 			if derr == nil {
+				metrics.Count(metricUnsubscribes, nil)
+				recordHistory(ctx, clients.DynamoDB, email, historyUnsubscribed, historyActorSelf, event.RequestContext.HTTP.SourceIP)
+				notifyOwner(ctx, ownerEventUnsubscribed, email)
+				emitWebhookEvent(ctx, clients.DynamoDB, webhookSubscriberUnsubscribed, email)
 				resp.Headers["Location"] = confirmUnsubscribe
 			} else {
-				log.Printf("Could not delete item: %s", derr)
+				log.Error("could not delete item", "error", derr)
+				countError("database")
 				resp.Headers["Location"] = errorPage
 			}
 			return resp, derr
 		}
 		// If details don't match, return error
 		if (match == false) || (err != nil) {
-			log.Printf("Received a bad deletion request with no match or an error. Error: %s\n Query string: %s", err, event.RawQueryString)
+			log.Warn("received a bad deletion request with no match or an error", "error", err, logKeyQuery, event.RawQueryString)
+			if err != nil {
+				countError("database")
+			} else {
+				countError("no_match")
+			}
 			resp.Headers["Location"] = errorPage
 			return resp, err
 		}
 	}
 
+	// Send the confirmation email again. The reply is the same whether or not
+	// anything was sent, so it can't be used to learn who is on the list.
+	if os.Getenv("RESEND_PATH") != "" && event.RawPath == fmt.Sprintf("/%s/", os.Getenv("RESEND_PATH")) {
+		email, err := parseSubscriberEmail(event.QueryStringParameters["email"])
+		if err != nil {
+			log.Warn("could not get email", "error", err)
+			countError("invalid_email")
+			resp.Headers["Location"] = errorPage
+			return resp, nil
+		}
+		// A failure could give away that the address has an item, so it gets
+		// the usual page too.
+		sent, err := resendConfirmation(ctx, clients, email)
+		if err != nil {
+			log.Error("could not resend confirmation email", "error", err)
+			countError("resend")
+		} else if sent {
+			metrics.Count(metricResends, nil)
+			metrics.Count(metricConfirmationEmailsSent, nil)
+		} else {
+			log.Info("not resending confirmation email", logKeyEmail, email)
+		}
+		resp.Headers["Location"] = confirmResend
+		return resp, nil
+	}
+
+	// Email a subscriber a copy of their data. Both email and id must match.
+	if os.Getenv("DATA_REQUEST_PATH") != "" && event.RawPath == fmt.Sprintf("/%s/", os.Getenv("DATA_REQUEST_PATH")) {
+		// Parse email and id from query string.
+		rawEmail, emailpresent := event.QueryStringParameters["email"]
+		id, idpresent := event.QueryStringParameters["id"]
+		if (emailpresent == false) || (idpresent == false) {
+			log.Warn("missing parameters in query string", logKeyQuery, event.RawQueryString)
+			countError("missing_parameters")
+			resp.Headers["Location"] = errorPage
+			return resp, nil
+		}
+		email, match, err := matchEmailWithId(ctx, clients.DynamoDB, rawEmail, id)
+		if match == true {
+			if serr := sendSubscriberData(ctx, clients, email); serr != nil {
+				log.Error("could not send subscriber data", "error", serr)
+				countError("email")
+				resp.Headers["Location"] = errorPage
+				return resp, serr
+			}
+			metrics.Count(metricDataRequests, nil)
+			resp.Headers["Location"] = confirmDataRequest
+			return resp, nil
+		}
+		log.Warn("received a bad data request with no match or an error", "error", err, logKeyQuery, event.RawQueryString)
+		if err != nil {
+			countError("database")
+		} else {
+			countError("no_match")
+		}
+		resp.Headers["Location"] = errorPage
+		return resp, err
+	}
+
 	// No event.RawPath match
-	log.Printf("No path match for path: %s", event.RawPath)
+	log.Warn("no path match", "path", event.RawPath)
+	countError("unknown_path")
 	resp.Headers["Location"] = errorPage
 	return resp, nil
 }
@@ -290,13 +788,40 @@ func lambdaHandler(ctx context.Context, clients *ServiceClients, event events.AP
 func main() {
 	cfg, err := config.LoadDefaultConfig(context.TODO())
 	if err != nil {
-		log.Fatalf("unable to load AWS SDK config: %s", err)
+		logger.Error("unable to load AWS SDK config", "error", err)
+		os.Exit(1)
+	}
+	if err := requireTombstoneSalt(); err != nil {
+		logger.Error("invalid configuration", "error", err)
+		os.Exit(1)
 	}
 	clients := &ServiceClients{
-		DynamoDB: dynamodb.NewFromConfig(cfg),
-		SES:      ses.NewFromConfig(cfg),
+		DynamoDB:    dynamodb.NewFromConfig(cfg),
+		SES:         ses.NewFromConfig(cfg),
+		SNS:         sns.NewFromConfig(cfg),
+		EventBridge: eventbridge.NewFromConfig(cfg),
+		Resolver:    net.DefaultResolver,
 	}
-	lambda.Start(func(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
-		return lambdaHandler(ctx, clients, event)
+	if err := setupTracing(context.TODO()); err != nil {
+		logger.Error("unable to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	notifier = newNotifier(envOrDefault("NOTIFY_BACKEND", "none"), clients)
+	eventSinks = newEventSinks(envOrDefault("STREAM_SINKS", "log"), clients)
+
+	if len(os.Args) > 1 {
+		// Keep command output on stdout separate from the logs.
+		logger = newLogger(os.Stderr)
+		if err := runCommand(context.Background(), clients, os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	metrics = newMetrics(envOrDefault("METRICS_BACKEND", "emf"))
+	lambda.Start(func(ctx context.Context, payload json.RawMessage) (any, error) {
+		defer flushTraces(ctx)
+		return handleEvent(ctx, clients, payload)
 	})
 }
@@ -5,7 +5,9 @@ import (
 	"errors"
 	"net/http"
 	"os"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -35,6 +37,36 @@ func (m *MockDynamoDBClient) DeleteItem(ctx context.Context, input *dynamodb.Del
 	return args.Get(0).(*dynamodb.DeleteItemOutput), args.Error(1)
 }
 
+func (m *MockDynamoDBClient) Scan(ctx context.Context, input *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*dynamodb.ScanOutput), args.Error(1)
+}
+
+func (m *MockDynamoDBClient) BatchWriteItem(ctx context.Context, input *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*dynamodb.BatchWriteItemOutput), args.Error(1)
+}
+
+func (m *MockDynamoDBClient) BatchGetItem(ctx context.Context, input *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*dynamodb.BatchGetItemOutput), args.Error(1)
+}
+
+func (m *MockDynamoDBClient) PutItem(ctx context.Context, input *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*dynamodb.PutItemOutput), args.Error(1)
+}
+
+func (m *MockDynamoDBClient) TransactWriteItems(ctx context.Context, input *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*dynamodb.TransactWriteItemsOutput), args.Error(1)
+}
+
+func (m *MockDynamoDBClient) Query(ctx context.Context, input *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*dynamodb.QueryOutput), args.Error(1)
+}
+
 // MockSESClient is a mock implementation of SESAPI
 type MockSESClient struct {
 	mock.Mock
@@ -45,6 +77,11 @@ func (m *MockSESClient) SendEmail(ctx context.Context, input *ses.SendEmailInput
 	return args.Get(0).(*ses.SendEmailOutput), args.Error(1)
 }
 
+func (m *MockSESClient) GetSendQuota(ctx context.Context, input *ses.GetSendQuotaInput, optFns ...func(*ses.Options)) (*ses.GetSendQuotaOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*ses.GetSendQuotaOutput), args.Error(1)
+}
+
 func TestEmailExistsWithId(t *testing.T) {
 	os.Setenv("DB_TABLE_NAME", "TestTable")
 
@@ -85,6 +122,36 @@ func TestEmailExistsWithId(t *testing.T) {
 			expectedExist:  false,
 			expectedErr:    nil,
 		},
+		{
+			name:  "Pending item has expired",
+			email: "test@example.com",
+			id:    "123",
+			mockGetItem: &dynamodb.GetItemOutput{
+				Item: map[string]dynamodbtypes.AttributeValue{
+					"email":      &dynamodbtypes.AttributeValueMemberS{Value: "test@example.com"},
+					"id":         &dynamodbtypes.AttributeValueMemberS{Value: "123"},
+					"expires_at": &dynamodbtypes.AttributeValueMemberN{Value: "1700000000"},
+				},
+			},
+			mockGetItemErr: nil,
+			expectedExist:  false,
+			expectedErr:    nil,
+		},
+		{
+			name:  "Pending item has not expired",
+			email: "test@example.com",
+			id:    "123",
+			mockGetItem: &dynamodb.GetItemOutput{
+				Item: map[string]dynamodbtypes.AttributeValue{
+					"email":      &dynamodbtypes.AttributeValueMemberS{Value: "test@example.com"},
+					"id":         &dynamodbtypes.AttributeValueMemberS{Value: "123"},
+					"expires_at": &dynamodbtypes.AttributeValueMemberN{Value: "99999999999"},
+				},
+			},
+			mockGetItemErr: nil,
+			expectedExist:  true,
+			expectedErr:    nil,
+		},
 		{
 			name:           "Email does not exist",
 			email:          "nonexistent@example.com",
@@ -110,7 +177,7 @@ func TestEmailExistsWithId(t *testing.T) {
 			mockSvc := new(MockDynamoDBClient)
 			mockSvc.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(tt.mockGetItem, tt.mockGetItemErr)
 
-			exists, err := emailExistsWithId(mockSvc, tt.email, tt.id)
+			exists, err := emailExistsWithId(context.Background(), mockSvc, tt.email, tt.id)
 
 			assert.Equal(t, tt.expectedExist, exists)
 			if tt.expectedErr != nil {
@@ -131,7 +198,7 @@ func TestUpdateItemInDynamoDB(t *testing.T) {
 		name              string
 		email             string
 		id                string
-		timestamp         string
+		now               time.Time
 		confirm           bool
 		mockUpdateItem    *dynamodb.UpdateItemOutput
 		mockUpdateItemErr error
@@ -141,7 +208,7 @@ func TestUpdateItemInDynamoDB(t *testing.T) {
 			name:              "Successful update",
 			email:             "test@example.com",
 			id:                "123",
-			timestamp:         "2023-01-01 12:00:00",
+			now:               time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC),
 			confirm:           true,
 			mockUpdateItem:    &dynamodb.UpdateItemOutput{},
 			mockUpdateItemErr: nil,
@@ -151,7 +218,7 @@ func TestUpdateItemInDynamoDB(t *testing.T) {
 			name:              "DynamoDB error during update",
 			email:             "error@example.com",
 			id:                "456",
-			timestamp:         "2023-01-01 12:00:00",
+			now:               time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC),
 			confirm:           false,
 			mockUpdateItem:    &dynamodb.UpdateItemOutput{},
 			mockUpdateItemErr: errors.New("DynamoDB update error"),
@@ -164,7 +231,7 @@ func TestUpdateItemInDynamoDB(t *testing.T) {
 			mockSvc := new(MockDynamoDBClient)
 			mockSvc.On("UpdateItem", mock.Anything, mock.AnythingOfType("*dynamodb.UpdateItemInput")).Return(tt.mockUpdateItem, tt.mockUpdateItemErr)
 
-			_, err := updateItemInDynamoDB(mockSvc, tt.email, tt.id, tt.timestamp, tt.confirm)
+			_, err := updateItemInDynamoDB(context.Background(), mockSvc, tt.email, tt.id, tt.now, tt.confirm, nil, nil)
 
 			if tt.expectedErr != nil {
 				assert.Error(t, err)
@@ -177,6 +244,60 @@ func TestUpdateItemInDynamoDB(t *testing.T) {
 	}
 }
 
+func TestUpdateItemInDynamoDBSetsExpiry(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	os.Setenv("PENDING_TTL", "1h")
+	defer os.Unsetenv("PENDING_TTL")
+
+	tests := []struct {
+		name               string
+		confirm            bool
+		expectedExpression string
+		expectExpiry       bool
+	}{
+		{
+			name:               "Pending item expires",
+			confirm:            false,
+			expectedExpression: "SET #C = :confirmval, #U = :nowval, #CA = if_not_exists(#CA, :nowval), #ID = :idval, #E = :expval REMOVE #CF, #RC, #RA",
+			expectExpiry:       true,
+		},
+		{
+			name:               "Confirmed item does not expire",
+			confirm:            true,
+			expectedExpression: "SET #C = :confirmval, #U = :nowval, #CA = if_not_exists(#CA, :nowval), #ID = :idval, #CF = if_not_exists(#CF, :nowval) REMOVE #E, #RC, #RA",
+			expectExpiry:       false,
+		},
+	}
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.FixedZone("CET", 60*60))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input *dynamodb.UpdateItemInput
+			mockSvc := new(MockDynamoDBClient)
+			mockSvc.On("UpdateItem", mock.Anything, mock.AnythingOfType("*dynamodb.UpdateItemInput")).Run(func(args mock.Arguments) {
+				input = args.Get(1).(*dynamodb.UpdateItemInput)
+			}).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+			_, err := updateItemInDynamoDB(context.Background(), mockSvc, "test@example.com", "123", now, tt.confirm, nil, nil)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedExpression, *input.UpdateExpression)
+			assert.Equal(t, "2023-01-01T11:00:00Z", input.ExpressionAttributeValues[":nowval"].(*dynamodbtypes.AttributeValueMemberS).Value)
+			exp, ok := input.ExpressionAttributeValues[":expval"].(*dynamodbtypes.AttributeValueMemberN)
+			assert.Equal(t, tt.expectExpiry, ok)
+			if ok {
+				assert.Equal(t, now.Add(time.Hour).Unix(), mustParseInt(t, exp.Value))
+			}
+		})
+	}
+}
+
+func mustParseInt(t *testing.T, s string) int64 {
+	n, err := strconv.ParseInt(s, 10, 64)
+	assert.NoError(t, err)
+	return n
+}
+
 func TestDeleteEmailFromDynamoDb(t *testing.T) {
 	os.Setenv("DB_TABLE_NAME", "TestTable")
 
@@ -184,7 +305,7 @@ func TestDeleteEmailFromDynamoDb(t *testing.T) {
 		name              string
 		email             string
 		id                string
-		mockDeleteItem    *dynamodb.DeleteItemOutput
+		mockTransact      *dynamodb.TransactWriteItemsOutput
 		mockDeleteItemErr error
 		expectedErr       error
 	}{
@@ -192,7 +313,7 @@ func TestDeleteEmailFromDynamoDb(t *testing.T) {
 			name:              "Successful deletion",
 			email:             "test@example.com",
 			id:                "123",
-			mockDeleteItem:    &dynamodb.DeleteItemOutput{},
+			mockTransact:      &dynamodb.TransactWriteItemsOutput{},
 			mockDeleteItemErr: nil,
 			expectedErr:       nil,
 		},
@@ -200,7 +321,7 @@ func TestDeleteEmailFromDynamoDb(t *testing.T) {
 			name:              "ConditionalCheckFailedException (ID mismatch)",
 			email:             "test@example.com",
 			id:                "456",
-			mockDeleteItem:    &dynamodb.DeleteItemOutput{},
+			mockTransact:      &dynamodb.TransactWriteItemsOutput{},
 			mockDeleteItemErr: errors.New("ConditionalCheckFailedException"),
 			expectedErr:       errors.New("ConditionalCheckFailedException"),
 		},
@@ -208,7 +329,7 @@ func TestDeleteEmailFromDynamoDb(t *testing.T) {
 			name:              "DynamoDB error during deletion",
 			email:             "error@example.com",
 			id:                "789",
-			mockDeleteItem:    &dynamodb.DeleteItemOutput{},
+			mockTransact:      &dynamodb.TransactWriteItemsOutput{},
 			mockDeleteItemErr: errors.New("DynamoDB delete error"),
 			expectedErr:       errors.New("DynamoDB delete error"),
 		},
@@ -217,9 +338,9 @@ func TestDeleteEmailFromDynamoDb(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			mockSvc := new(MockDynamoDBClient)
-			mockSvc.On("DeleteItem", mock.Anything, mock.AnythingOfType("*dynamodb.DeleteItemInput")).Return(tt.mockDeleteItem, tt.mockDeleteItemErr)
+			mockSvc.On("TransactWriteItems", mock.Anything, mock.AnythingOfType("*dynamodb.TransactWriteItemsInput")).Return(tt.mockTransact, tt.mockDeleteItemErr)
 
-			_, err := deleteEmailFromDynamoDb(mockSvc, tt.email, tt.id)
+			_, err := deleteEmailFromDynamoDb(context.Background(), mockSvc, tt.email, tt.id)
 
 			if tt.expectedErr != nil {
 				assert.Error(t, err)
@@ -269,7 +390,7 @@ func TestSendEmailWithSES(t *testing.T) {
 			mockSvc := new(MockSESClient)
 			mockSvc.On("SendEmail", mock.Anything, mock.AnythingOfType("*ses.SendEmailInput")).Return(tt.mockSendEmail, tt.mockSendEmailErr)
 
-			_, err := sendEmailWithSES(mockSvc, tt.email, tt.id)
+			_, err := sendEmailWithSES(context.Background(), mockSvc, tt.email, tt.id)
 
 			if tt.expectedErr != nil {
 				assert.Error(t, err)
@@ -322,6 +443,8 @@ func TestLambdaHandler(t *testing.T) {
 				},
 			},
 			setupMocks: func() {
+				mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{}, nil).Once()
+				expectNoTombstone(mockDynamoDB, "new@example.com")
 				mockDynamoDB.On("UpdateItem", mock.Anything, mock.AnythingOfType("*dynamodb.UpdateItemInput")).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
 				mockSES.On("SendEmail", mock.Anything, mock.AnythingOfType("*ses.SendEmailInput")).Return(&ses.SendEmailOutput{}, nil).Once()
 			},
@@ -351,6 +474,8 @@ func TestLambdaHandler(t *testing.T) {
 				},
 			},
 			setupMocks: func() {
+				mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{}, nil).Once()
+				expectNoTombstone(mockDynamoDB, "db-error@example.com")
 				mockDynamoDB.On("UpdateItem", mock.Anything, mock.AnythingOfType("*dynamodb.UpdateItemInput")).Return(&dynamodb.UpdateItemOutput{}, errors.New("db error")).Once()
 			},
 			expectedStatus:   http.StatusSeeOther,
@@ -366,6 +491,8 @@ func TestLambdaHandler(t *testing.T) {
 				},
 			},
 			setupMocks: func() {
+				mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{}, nil).Once()
+				expectNoTombstone(mockDynamoDB, "ses-error@example.com")
 				mockDynamoDB.On("UpdateItem", mock.Anything, mock.AnythingOfType("*dynamodb.UpdateItemInput")).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
 				mockSES.On("SendEmail", mock.Anything, mock.AnythingOfType("*ses.SendEmailInput")).Return(&ses.SendEmailOutput{}, errors.New("ses error")).Once()
 			},
@@ -373,6 +500,29 @@ func TestLambdaHandler(t *testing.T) {
 			expectedLocation: "https://example.com/error",
 			expectedErr:      errors.New("ses error"),
 		},
+		{
+			name: "Subscribe - Already Confirmed",
+			event: events.APIGatewayV2HTTPRequest{
+				RawPath: "/subscribe/",
+				QueryStringParameters: map[string]string{
+					"email": "confirmed@example.com",
+				},
+			},
+			setupMocks: func() {
+				// Nothing is written or sent, so the subscriber stays confirmed.
+				mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{
+					Item: map[string]dynamodbtypes.AttributeValue{
+						"email":        &dynamodbtypes.AttributeValueMemberS{Value: "confirmed@example.com"},
+						"id":           &dynamodbtypes.AttributeValueMemberS{Value: "1"},
+						"confirm":      &dynamodbtypes.AttributeValueMemberBOOL{Value: true},
+						"confirmed_at": &dynamodbtypes.AttributeValueMemberS{Value: "2024-01-01T00:00:00Z"},
+					},
+				}, nil).Once()
+			},
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "https://example.com/confirm-subscribe",
+			expectedErr:      nil,
+		},
 		{
 			name: "Verify - Success",
 			event: events.APIGatewayV2HTTPRequest{
@@ -390,6 +540,8 @@ func TestLambdaHandler(t *testing.T) {
 					},
 				}, nil).Once()
 				mockDynamoDB.On("UpdateItem", mock.Anything, mock.AnythingOfType("*dynamodb.UpdateItemInput")).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+				// Confirming clears any opt-out.
+				mockDynamoDB.On("DeleteItem", mock.Anything, mock.AnythingOfType("*dynamodb.DeleteItemInput")).Return(&dynamodb.DeleteItemOutput{}, nil).Once()
 			},
 			expectedStatus:   http.StatusSeeOther,
 			expectedLocation: "https://example.com/success",
@@ -429,6 +581,28 @@ func TestLambdaHandler(t *testing.T) {
 			expectedLocation: "https://example.com/error",
 			expectedErr:      nil,
 		},
+		{
+			name: "Verify - Expired",
+			event: events.APIGatewayV2HTTPRequest{
+				RawPath: "/verify/",
+				QueryStringParameters: map[string]string{
+					"email": "expired@example.com",
+					"id":    "expired-id",
+				},
+			},
+			setupMocks: func() {
+				mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{
+					Item: map[string]dynamodbtypes.AttributeValue{
+						"email":      &dynamodbtypes.AttributeValueMemberS{Value: "expired@example.com"},
+						"id":         &dynamodbtypes.AttributeValueMemberS{Value: "expired-id"},
+						"expires_at": &dynamodbtypes.AttributeValueMemberN{Value: "1700000000"},
+					},
+				}, nil).Once()
+			},
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "https://example.com/error",
+			expectedErr:      nil,
+		},
 		{
 			name: "Verify - DynamoDB Get Error",
 			event: events.APIGatewayV2HTTPRequest{
@@ -483,7 +657,7 @@ func TestLambdaHandler(t *testing.T) {
 						"id":    &dynamodbtypes.AttributeValueMemberS{Value: "unsub-id"},
 					},
 				}, nil).Once()
-				mockDynamoDB.On("DeleteItem", mock.Anything, mock.AnythingOfType("*dynamodb.DeleteItemInput")).Return(&dynamodb.DeleteItemOutput{}, nil).Once()
+				mockDynamoDB.On("TransactWriteItems", mock.Anything, mock.AnythingOfType("*dynamodb.TransactWriteItemsInput")).Return(&dynamodb.TransactWriteItemsOutput{}, nil).Once()
 			},
 			expectedStatus:   http.StatusSeeOther,
 			expectedLocation: "https://example.com/confirm-unsubscribe",
@@ -555,7 +729,7 @@ func TestLambdaHandler(t *testing.T) {
 						"id":    &dynamodbtypes.AttributeValueMemberS{Value: "some-id"},
 					},
 				}, nil).Once()
-				mockDynamoDB.On("DeleteItem", mock.Anything, mock.AnythingOfType("*dynamodb.DeleteItemInput")).Return(&dynamodb.DeleteItemOutput{}, errors.New("delete error")).Once()
+				mockDynamoDB.On("TransactWriteItems", mock.Anything, mock.AnythingOfType("*dynamodb.TransactWriteItemsInput")).Return(&dynamodb.TransactWriteItemsOutput{}, errors.New("delete error")).Once()
 			},
 			expectedStatus:   http.StatusSeeOther,
 			expectedLocation: "https://example.com/error",
@@ -599,3 +773,51 @@ func TestLambdaHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestWithTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected time.Duration
+	}{
+		{name: "Unset uses default", value: "", expected: 3 * time.Second},
+		{name: "Valid duration", value: "500ms", expected: 500 * time.Millisecond},
+		{name: "Invalid duration uses default", value: "soon", expected: 3 * time.Second},
+		{name: "Negative duration uses default", value: "-1s", expected: 3 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("TEST_TIMEOUT", tt.value)
+			defer os.Unsetenv("TEST_TIMEOUT")
+
+			start := time.Now()
+			ctx, cancel := withTimeout(context.Background(), "TEST_TIMEOUT", 3*time.Second)
+			defer cancel()
+
+			deadline, ok := ctx.Deadline()
+			assert.True(t, ok)
+			assert.WithinDuration(t, start.Add(tt.expected), deadline, 100*time.Millisecond)
+		})
+	}
+}
+
+func TestAWSCallsUseRequestContext(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+
+	// A canceled parent context must reach the AWS client so in-flight calls stop.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	mockSvc := new(MockDynamoDBClient)
+	mockSvc.On("GetItem", mock.MatchedBy(func(c context.Context) bool {
+		_, hasDeadline := c.Deadline()
+		return c.Err() == context.Canceled && hasDeadline
+	}), mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{}, context.Canceled)
+
+	exists, err := emailExistsWithId(ctx, mockSvc, "test@example.com", "123")
+
+	assert.False(t, exists)
+	assert.ErrorIs(t, err, context.Canceled)
+	mockSvc.AssertExpectations(t)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metric names for the signup funnel.
+const (
+	metricSubscribeRequests      = "SubscribeRequests"
+	metricConfirmationEmailsSent = "ConfirmationEmailsSent"
+	metricVerifications          = "Verifications"
+	metricUnsubscribes           = "Unsubscribes"
+	metricDataRequests           = "DataRequests"
+	metricResends                = "ConfirmationResends"
+	metricBlockedSignups         = "BlockedSignups"
+	metricErrors                 = "Errors"
+	metricBackendLatency         = "BackendLatency"
+)
+
+// Metrics records counts and latencies. Labels become CloudWatch dimensions or
+// Prometheus labels; a given metric name must always be used with the same label keys.
+type Metrics interface {
+	Count(name string, labels map[string]string)
+	Observe(name string, d time.Duration, labels map[string]string)
+}
+
+// metrics is replaced in main according to METRICS_BACKEND.
+var metrics Metrics = noopMetrics{}
+
+// Create the Metrics implementation named by backend: "emf", "prometheus", or "none".
+func newMetrics(backend string) Metrics {
+	switch backend {
+	case "emf":
+		return newEMFMetrics(os.Stdout, envOrDefault("METRICS_NAMESPACE", "SimpleSubscribe"))
+	case "prometheus":
+		return newPrometheusMetrics(prometheus.DefaultRegisterer)
+	}
+	return noopMetrics{}
+}
+
+// Return the value of the environment variable key, or def if it is unset.
+func envOrDefault(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// Record the failure of a request, by type, e.g. "database" or "invalid_email".
+func countError(errorType string) {
+	metrics.Count(metricErrors, map[string]string{"ErrorType": errorType})
+}
+
+// Record how long a call to a backend service took.
+func observeBackend(operation string, start time.Time) {
+	metrics.Observe(metricBackendLatency, time.Since(start), map[string]string{"Operation": operation})
+}
+
+// noopMetrics discards everything.
+type noopMetrics struct{}
+
+func (noopMetrics) Count(string, map[string]string)                  {}
+func (noopMetrics) Observe(string, time.Duration, map[string]string) {}
+
+// emfMetrics writes each data point as a CloudWatch Embedded Metric Format log
+// line. CloudWatch extracts the metrics from the Lambda logs asynchronously.
+type emfMetrics struct {
+	mu        sync.Mutex
+	w         io.Writer
+	namespace string
+}
+
+func newEMFMetrics(w io.Writer, namespace string) *emfMetrics {
+	return &emfMetrics{w: w, namespace: namespace}
+}
+
+func (m *emfMetrics) Count(name string, labels map[string]string) {
+	m.write(name, 1, "Count", labels)
+}
+
+func (m *emfMetrics) Observe(name string, d time.Duration, labels map[string]string) {
+	m.write(name, float64(d.Microseconds())/1000, "Milliseconds", labels)
+}
+
+func (m *emfMetrics) write(name string, value float64, unit string, labels map[string]string) {
+	dims := make([]string, 0, len(labels))
+	for k := range labels {
+		dims = append(dims, k)
+	}
+	sort.Strings(dims)
+
+	line := map[string]any{
+		"_aws": map[string]any{
+			"Timestamp": time.Now().UnixMilli(),
+			"CloudWatchMetrics": []map[string]any{{
+				"Namespace":  m.namespace,
+				"Dimensions": [][]string{dims},
+				"Metrics":    []map[string]string{{"Name": name, "Unit": unit}},
+			}},
+		},
+		name: value,
+	}
+	for k, v := range labels {
+		line[k] = v
+	}
+
+	b, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.w.Write(append(b, '\n'))
+}
+
+// prometheusMetrics keeps counters and histograms for scraping in server mode.
+// Collectors are created and registered the first time each name is used.
+type prometheusMetrics struct {
+	mu         sync.Mutex
+	registerer prometheus.Registerer
+	counters   map[string]*prometheus.CounterVec
+	histograms map[string]*prometheus.HistogramVec
+}
+
+func newPrometheusMetrics(registerer prometheus.Registerer) *prometheusMetrics {
+	return &prometheusMetrics{
+		registerer: registerer,
+		counters:   make(map[string]*prometheus.CounterVec),
+		histograms: make(map[string]*prometheus.HistogramVec),
+	}
+}
+
+func (m *prometheusMetrics) Count(name string, labels map[string]string) {
+	m.mu.Lock()
+	c, ok := m.counters[name]
+	if !ok {
+		c = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "simple_subscribe_" + snakeCase(name) + "_total",
+			Help: "Total " + name + ".",
+		}, promLabelNames(labels))
+		m.registerer.MustRegister(c)
+		m.counters[name] = c
+	}
+	m.mu.Unlock()
+	c.With(promLabels(labels)).Inc()
+}
+
+func (m *prometheusMetrics) Observe(name string, d time.Duration, labels map[string]string) {
+	m.mu.Lock()
+	h, ok := m.histograms[name]
+	if !ok {
+		h = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "simple_subscribe_" + snakeCase(name) + "_seconds",
+			Help: name + " in seconds.",
+		}, promLabelNames(labels))
+		m.registerer.MustRegister(h)
+		m.histograms[name] = h
+	}
+	m.mu.Unlock()
+	h.With(promLabels(labels)).Observe(d.Seconds())
+}
+
+// Serve the default Prometheus registry.
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+func promLabelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, snakeCase(k))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func promLabels(labels map[string]string) prometheus.Labels {
+	out := make(prometheus.Labels, len(labels))
+	for k, v := range labels {
+		out[snakeCase(k)] = v
+	}
+	return out
+}
+
+// Convert a CamelCase name to snake_case.
+func snakeCase(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEMFMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	m := newEMFMetrics(&buf, "TestNamespace")
+
+	m.Count(metricErrors, map[string]string{"ErrorType": "database"})
+	m.Observe(metricBackendLatency, 1500*time.Microsecond, map[string]string{"Operation": "GetItem"})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+
+	var count map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &count))
+	assert.Equal(t, float64(1), count[metricErrors])
+	assert.Equal(t, "database", count["ErrorType"])
+	directive := count["_aws"].(map[string]any)["CloudWatchMetrics"].([]any)[0].(map[string]any)
+	assert.Equal(t, "TestNamespace", directive["Namespace"])
+	assert.Equal(t, []any{[]any{"ErrorType"}}, directive["Dimensions"])
+	assert.Equal(t, []any{map[string]any{"Name": metricErrors, "Unit": "Count"}}, directive["Metrics"])
+
+	var latency map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &latency))
+	assert.Equal(t, 1.5, latency[metricBackendLatency])
+	assert.Equal(t, "GetItem", latency["Operation"])
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := newPrometheusMetrics(registry)
+
+	m.Count(metricSubscribeRequests, nil)
+	m.Count(metricSubscribeRequests, nil)
+	m.Count(metricErrors, map[string]string{"ErrorType": "email"})
+	m.Observe(metricBackendLatency, time.Second, map[string]string{"Operation": "SendEmail"})
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.counters[metricSubscribeRequests]))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.counters[metricErrors].WithLabelValues("email")))
+
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	var names []string
+	for _, f := range families {
+		names = append(names, f.GetName())
+	}
+	assert.ElementsMatch(t, []string{
+		"simple_subscribe_subscribe_requests_total",
+		"simple_subscribe_errors_total",
+		"simple_subscribe_backend_latency_seconds",
+	}, names)
+}
+
+func TestSnakeCase(t *testing.T) {
+	assert.Equal(t, "confirmation_emails_sent", snakeCase("ConfirmationEmailsSent"))
+	assert.Equal(t, "error_type", snakeCase("ErrorType"))
+	assert.Equal(t, "already_snake", snakeCase("already_snake"))
+}
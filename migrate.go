@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// migrateReport describes the outcome of a timestamp migration.
+type migrateReport struct {
+	Migrated   int
+	Unreadable []string
+}
+
+// Replace the legacy timestamp on every subscriber with created_at,
+// confirmed_at, and updated_at.
+func runMigrateTimestamps(ctx context.Context, clients *ServiceClients, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("migrate-timestamps", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would be migrated without changing anything")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := migrateTimestamps(ctx, clients.DynamoDB, *dryRun)
+	verb := "migrated"
+	if *dryRun {
+		verb = "would migrate"
+	}
+	fmt.Fprintf(w, "%s: %d\nunreadable: %d\n", verb, report.Migrated, len(report.Unreadable))
+	for _, email := range report.Unreadable {
+		fmt.Fprintf(w, "  %s\n", email)
+	}
+	return err
+}
+
+// Migrate each subscriber that still has a legacy timestamp. Items with a
+// timestamp that can't be read are left alone and reported.
+func migrateTimestamps(ctx context.Context, svc DynamoDBAPI, dryRun bool) (migrateReport, error) {
+	var report migrateReport
+	err := scanSubscribers(ctx, svc, "attribute_exists(#C) AND attribute_exists(#T)",
+		map[string]string{"#C": "confirm", "#T": "timestamp"},
+		nil,
+		func(sub subscriber) error {
+			if sub.CreatedAt == "" {
+				report.Unreadable = append(report.Unreadable, sub.Email)
+				return nil
+			}
+			if !dryRun {
+				if err := migrateSubscriberTimestamp(ctx, svc, sub); err != nil {
+					return err
+				}
+			}
+			report.Migrated++
+			return nil
+		},
+	)
+	return report, err
+}
+
+// Save a subscriber's times, as filled in from their legacy timestamp, and
+// remove the timestamp. Times the item already has are kept.
+func migrateSubscriberTimestamp(ctx context.Context, svc DynamoDBAPI, sub subscriber) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv("DB_TABLE_NAME")),
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"email": &dynamodbtypes.AttributeValueMemberS{Value: sub.Email},
+		},
+		ExpressionAttributeNames: map[string]string{
+			"#CA": "created_at",
+			"#U":  "updated_at",
+			"#T":  "timestamp",
+		},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":created": &dynamodbtypes.AttributeValueMemberS{Value: sub.CreatedAt},
+			":updated": &dynamodbtypes.AttributeValueMemberS{Value: sub.UpdatedAt},
+			":legacy":  &dynamodbtypes.AttributeValueMemberS{Value: sub.Timestamp},
+		},
+		// Leave the item alone if it changed since it was read.
+		ConditionExpression: aws.String("#T = :legacy"),
+	}
+	set := "SET #CA = if_not_exists(#CA, :created), #U = if_not_exists(#U, :updated)"
+	if sub.ConfirmedAt != "" {
+		input.ExpressionAttributeNames["#CF"] = "confirmed_at"
+		input.ExpressionAttributeValues[":confirmed"] = &dynamodbtypes.AttributeValueMemberS{Value: sub.ConfirmedAt}
+		set += ", #CF = if_not_exists(#CF, :confirmed)"
+	}
+	input.UpdateExpression = aws.String(set + " REMOVE #T")
+
+	ctx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "DynamoDB", "UpdateItem")
+	defer span.End()
+	defer observeBackend("UpdateItem", time.Now())
+	_, err := svc.UpdateItem(ctx, input)
+	var changed *dynamodbtypes.ConditionalCheckFailedException
+	if errors.As(err, &changed) {
+		// The handler removes the timestamp whenever it updates an item.
+		return nil
+	}
+	if err != nil {
+		recordSpanError(span, err)
+		loggerFrom(ctx).Error("could not migrate item", "error", err, logKeyEmail, sub.Email)
+	}
+	return err
+}
+
+// Replace the created_at an update just saved on an unmigrated item with the
+// time from its legacy timestamp, along with confirmed_at if it was and still
+// is confirmed, and remove the timestamp. old is the item as it was before the
+// update. Items with a timestamp that can't be read are left for
+// migrate-timestamps to report.
+func keepLegacyTimes(ctx context.Context, svc DynamoDBAPI, email string, confirm bool, old map[string]dynamodbtypes.AttributeValue) error {
+	if _, ok := old["timestamp"]; !ok {
+		return nil
+	}
+	var sub subscriber
+	if err := attributevalue.UnmarshalMap(old, &sub); err != nil {
+		return err
+	}
+	// Times saved alongside the timestamp came from updates like this one.
+	sub.CreatedAt, sub.ConfirmedAt = "", ""
+	if !sub.fillLegacyTimes() {
+		return nil
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv("DB_TABLE_NAME")),
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"email": &dynamodbtypes.AttributeValueMemberS{Value: email},
+		},
+		ExpressionAttributeNames: map[string]string{
+			"#CA": "created_at",
+			"#T":  "timestamp",
+		},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":created": &dynamodbtypes.AttributeValueMemberS{Value: sub.CreatedAt},
+			":legacy":  &dynamodbtypes.AttributeValueMemberS{Value: sub.Timestamp},
+		},
+		ConditionExpression: aws.String("#T = :legacy"),
+	}
+	set := "SET #CA = :created"
+	if confirm && sub.Confirm {
+		input.ExpressionAttributeNames["#CF"] = "confirmed_at"
+		input.ExpressionAttributeValues[":confirmed"] = &dynamodbtypes.AttributeValueMemberS{Value: sub.ConfirmedAt}
+		set += ", #CF = :confirmed"
+	}
+	input.UpdateExpression = aws.String(set + " REMOVE #T")
+
+	ctx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "DynamoDB", "UpdateItem")
+	defer span.End()
+	defer observeBackend("UpdateItem", time.Now())
+	_, err := svc.UpdateItem(ctx, input)
+	var changed *dynamodbtypes.ConditionalCheckFailedException
+	if errors.As(err, &changed) {
+		// Another request already did this.
+		return nil
+	}
+	if err != nil {
+		recordSpanError(span, err)
+		loggerFrom(ctx).Error("could not keep legacy times", "error", err, logKeyEmail, email)
+	}
+	return err
+}
+
+// emailMigrateReport describes the outcome of an address migration.
+type emailMigrateReport struct {
+	Moved   int
+	Merged  int
+	Changed int
+	Invalid []string
+}
+
+// Re-key every subscriber saved before addresses were normalized, so each
+// mailbox has one item.
+func runMigrateEmails(ctx context.Context, clients *ServiceClients, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("migrate-emails", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would be migrated without changing anything")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := migrateEmails(ctx, clients.DynamoDB, *dryRun)
+	verb := ""
+	if *dryRun {
+		verb = "would be "
+	}
+	fmt.Fprintf(w, "%smoved: %d\n%smerged: %d\nchanged during migration: %d\ninvalid: %d\n",
+		verb, report.Moved, verb, report.Merged, report.Changed, len(report.Invalid))
+	for _, email := range report.Invalid {
+		fmt.Fprintf(w, "  %s\n", email)
+	}
+	return err
+}
+
+// Move each subscriber whose key isn't its normalized address to that key. If
+// the normalized address already has an item, the two are merged by keeping
+// the confirmed one, or the normalized one if both or neither are confirmed.
+// Items whose address can't be normalized are left alone and reported.
+func migrateEmails(ctx context.Context, svc DynamoDBAPI, dryRun bool) (emailMigrateReport, error) {
+	var report emailMigrateReport
+	input := &dynamodb.ScanInput{
+		TableName:                aws.String(os.Getenv("DB_TABLE_NAME")),
+		FilterExpression:         aws.String("attribute_exists(#C)"),
+		ExpressionAttributeNames: map[string]string{"#C": "confirm"},
+	}
+	paginator := dynamodb.NewScanPaginator(svc, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			loggerFrom(ctx).Error("could not scan table", "error", err)
+			return report, err
+		}
+		for _, item := range page.Items {
+			var sub subscriber
+			if err := attributevalue.UnmarshalMap(item, &sub); err != nil {
+				return report, err
+			}
+			email, err := normalizeEmail(sub.Email)
+			if err != nil {
+				report.Invalid = append(report.Invalid, sub.Email)
+				continue
+			}
+			if email == sub.Email {
+				continue
+			}
+			target, err := getSubscriberItem(ctx, svc, email)
+			if err != nil {
+				return report, err
+			}
+			if dryRun {
+				if target == nil {
+					report.Moved++
+				} else {
+					report.Merged++
+				}
+				continue
+			}
+			moved, err := moveSubscriberItem(ctx, svc, item, sub, email, target)
+			switch {
+			case err != nil:
+				return report, err
+			case !moved:
+				report.Changed++
+			case target == nil:
+				report.Moved++
+			default:
+				report.Merged++
+			}
+		}
+	}
+	return report, nil
+}
+
+// Replace a legacy item with one keyed by its normalized address, in one
+// transaction. target is the item already at that address, if any, which is
+// only replaced if the legacy item is confirmed and it isn't. Reports false if
+// either item changed since it was read, leaving both alone.
+func moveSubscriberItem(ctx context.Context, svc DynamoDBAPI, item map[string]dynamodbtypes.AttributeValue, sub subscriber, email string, target map[string]dynamodbtypes.AttributeValue) (bool, error) {
+	table := os.Getenv("DB_TABLE_NAME")
+	remove := dynamodbtypes.TransactWriteItem{Delete: &dynamodbtypes.Delete{
+		TableName: aws.String(table),
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"email": &dynamodbtypes.AttributeValueMemberS{Value: sub.Email},
+		},
+		ConditionExpression:       aws.String("#ID = :idval"),
+		ExpressionAttributeNames:  map[string]string{"#ID": "id"},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{":idval": item["id"]},
+	}}
+	items := []dynamodbtypes.TransactWriteItem{remove}
+
+	moved := make(map[string]dynamodbtypes.AttributeValue, len(item))
+	for k, v := range item {
+		moved[k] = v
+	}
+	moved["email"] = &dynamodbtypes.AttributeValueMemberS{Value: email}
+	put := &dynamodbtypes.Put{
+		TableName: aws.String(table),
+		Item:      moved,
+	}
+	switch {
+	case target == nil:
+		put.ConditionExpression = aws.String("attribute_not_exists(email)")
+		items = append(items, dynamodbtypes.TransactWriteItem{Put: put})
+	case sub.Confirm && !wasConfirmed(target):
+		put.ConditionExpression = aws.String("#ID = :idval")
+		put.ExpressionAttributeNames = map[string]string{"#ID": "id"}
+		put.ExpressionAttributeValues = map[string]dynamodbtypes.AttributeValue{":idval": target["id"]}
+		items = append(items, dynamodbtypes.TransactWriteItem{Put: put})
+	}
+
+	ctx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "DynamoDB", "TransactWriteItems")
+	defer span.End()
+	defer observeBackend("TransactWriteItems", time.Now())
+	_, err := svc.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	var canceled *dynamodbtypes.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		return false, nil
+	}
+	if err != nil {
+		recordSpanError(span, err)
+		loggerFrom(ctx).Error("could not migrate item", "error", err, logKeyEmail, sub.Email)
+		return false, err
+	}
+	return true, nil
+}
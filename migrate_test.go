@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMigrateTimestamps(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+
+	tests := []struct {
+		name          string
+		args          []string
+		expectUpdates bool
+		expectedOut   string
+	}{
+		{
+			name:          "Migrate",
+			expectUpdates: true,
+			expectedOut:   "migrated: 2\nunreadable: 1\n  bad@example.com\n",
+		},
+		{
+			name:        "Dry run",
+			args:        []string{"-dry-run"},
+			expectedOut: "would migrate: 2\nunreadable: 1\n  bad@example.com\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := new(MockDynamoDBClient)
+			db.On("Scan", mock.Anything, mock.MatchedBy(func(in *dynamodb.ScanInput) bool {
+				return *in.FilterExpression == "attribute_exists(#C) AND attribute_exists(#T)"
+			})).Return(&dynamodb.ScanOutput{Items: []map[string]dynamodbtypes.AttributeValue{
+				subscriberItem("confirmed@example.com", "1", true, "2024-01-01 00:00:00"),
+				subscriberItem("pending@example.com", "2", false, "2024-01-02 00:00:00"),
+				subscriberItem("bad@example.com", "3", false, "yesterday"),
+			}}, nil).Once()
+			if tt.expectUpdates {
+				db.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+					return in.Key["email"].(*dynamodbtypes.AttributeValueMemberS).Value == "confirmed@example.com" &&
+						*in.UpdateExpression == "SET #CA = if_not_exists(#CA, :created), #U = if_not_exists(#U, :updated), #CF = if_not_exists(#CF, :confirmed) REMOVE #T" &&
+						in.ExpressionAttributeValues[":confirmed"].(*dynamodbtypes.AttributeValueMemberS).Value == "2024-01-01T00:00:00Z" &&
+						in.ExpressionAttributeValues[":legacy"].(*dynamodbtypes.AttributeValueMemberS).Value == "2024-01-01 00:00:00"
+				})).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+				// The pending item changed since it was read, so it has already been migrated.
+				db.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+					return in.Key["email"].(*dynamodbtypes.AttributeValueMemberS).Value == "pending@example.com" &&
+						*in.UpdateExpression == "SET #CA = if_not_exists(#CA, :created), #U = if_not_exists(#U, :updated) REMOVE #T" &&
+						in.ExpressionAttributeValues[":created"].(*dynamodbtypes.AttributeValueMemberS).Value == "2024-01-02T00:00:00Z"
+				})).Return(&dynamodb.UpdateItemOutput{}, &dynamodbtypes.ConditionalCheckFailedException{Message: aws.String("changed")}).Once()
+			}
+
+			var out bytes.Buffer
+			err := runMigrateTimestamps(context.Background(), &ServiceClients{DynamoDB: db}, tt.args, &out)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedOut, out.String())
+			db.AssertExpectations(t)
+		})
+	}
+}
+
+func TestVerifyUsesClock(t *testing.T) {
+	os.Setenv("VERIFY_PATH", "verify")
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	defer func(c func() time.Time) { clock = c }(clock)
+	clock = func() time.Time { return time.Date(2024, 6, 1, 14, 0, 0, 0, time.FixedZone("CEST", 2*60*60)) }
+
+	mockDynamoDB := new(MockDynamoDBClient)
+	mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{
+		Item: subscriberItem("a@example.com", "1", false, "2024-06-01 11:00:00"),
+	}, nil).Once()
+	mockDynamoDB.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+		consent := in.ExpressionAttributeValues[":consentval"].(*dynamodbtypes.AttributeValueMemberM)
+		return in.ExpressionAttributeValues[":nowval"].(*dynamodbtypes.AttributeValueMemberS).Value == "2024-06-01T12:00:00Z" &&
+			consent.Value["time"].(*dynamodbtypes.AttributeValueMemberS).Value == "2024-06-01T12:00:00Z"
+	})).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+	mockDynamoDB.On("DeleteItem", mock.Anything, mock.AnythingOfType("*dynamodb.DeleteItemInput")).Return(&dynamodb.DeleteItemOutput{}, nil).Once()
+
+	_, err := lambdaHandler(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB}, events.APIGatewayV2HTTPRequest{
+		RawPath:               "/verify/",
+		QueryStringParameters: map[string]string{"email": "a@example.com", "id": "1"},
+	})
+
+	assert.NoError(t, err)
+	mockDynamoDB.AssertExpectations(t)
+}
+
+func TestUpdateKeepsLegacyTimes(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name               string
+		old                map[string]dynamodbtypes.AttributeValue
+		confirm            bool
+		expectedExpression string
+	}{
+		{name: "Migrated item"},
+		{
+			name:               "Pending item resubscribes",
+			old:                subscriberItem("a@example.com", "1", false, "2024-01-01 00:00:00"),
+			expectedExpression: "SET #CA = :created REMOVE #T",
+		},
+		{
+			name:               "Pending item confirms",
+			old:                subscriberItem("a@example.com", "1", false, "2024-01-01 00:00:00"),
+			confirm:            true,
+			expectedExpression: "SET #CA = :created REMOVE #T",
+		},
+		{
+			name:               "Confirmed item confirms again",
+			old:                subscriberItem("a@example.com", "1", true, "2024-01-01 00:00:00"),
+			confirm:            true,
+			expectedExpression: "SET #CA = :created, #CF = :confirmed REMOVE #T",
+		},
+		{name: "Unreadable timestamp", old: subscriberItem("a@example.com", "1", false, "yesterday")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockSvc := new(MockDynamoDBClient)
+			mockSvc.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+				return in.ReturnValues == dynamodbtypes.ReturnValueAllOld
+			})).Return(&dynamodb.UpdateItemOutput{Attributes: tt.old}, nil).Once()
+			if tt.expectedExpression != "" {
+				mockSvc.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+					return *in.UpdateExpression == tt.expectedExpression &&
+						*in.ConditionExpression == "#T = :legacy" &&
+						in.ExpressionAttributeValues[":created"].(*dynamodbtypes.AttributeValueMemberS).Value == "2024-01-01T00:00:00Z"
+				})).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+			}
+
+			_, err := updateItemInDynamoDB(context.Background(), mockSvc, "a@example.com", "2", now, tt.confirm, nil, nil)
+
+			assert.NoError(t, err)
+			mockSvc.AssertExpectations(t)
+		})
+	}
+}
+
+func TestMigrateEmails(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	getKey := func(email string) any {
+		return mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+			return in.Key["email"].(*dynamodbtypes.AttributeValueMemberS).Value == email
+		})
+	}
+	moving := func(from string) func(*dynamodb.TransactWriteItemsInput) bool {
+		return func(in *dynamodb.TransactWriteItemsInput) bool {
+			return in.TransactItems[0].Delete.Key["email"].(*dynamodbtypes.AttributeValueMemberS).Value == from
+		}
+	}
+
+	db := new(MockDynamoDBClient)
+	db.On("Scan", mock.Anything, mock.MatchedBy(func(in *dynamodb.ScanInput) bool {
+		return *in.FilterExpression == "attribute_exists(#C)"
+	})).Return(&dynamodb.ScanOutput{Items: []map[string]dynamodbtypes.AttributeValue{
+		subscriberItem("Moved@Example.com", "1", true, "2024-01-01 00:00:00"),
+		subscriberItem("Dup@Example.com", "2", false, "2024-01-02 00:00:00"),
+		subscriberItem("Busy@Example.com", "3", false, "2024-01-03 00:00:00"),
+		subscriberItem("ok@example.com", "4", true, "2024-01-04 00:00:00"),
+		subscriberItem("not an address", "5", true, "2024-01-05 00:00:00"),
+	}}, nil).Once()
+	db.On("GetItem", mock.Anything, getKey("moved@example.com")).Return(&dynamodb.GetItemOutput{}, nil).Once()
+	db.On("GetItem", mock.Anything, getKey("dup@example.com")).Return(&dynamodb.GetItemOutput{
+		Item: subscriberItem("dup@example.com", "9", true, "2024-01-01 00:00:00"),
+	}, nil).Once()
+	db.On("GetItem", mock.Anything, getKey("busy@example.com")).Return(&dynamodb.GetItemOutput{}, nil).Once()
+
+	// The item moves to its normalized key only if that key is free.
+	db.On("TransactWriteItems", mock.Anything, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		put := in.TransactItems[1].Put
+		return moving("Moved@Example.com")(in) &&
+			put.Item["email"].(*dynamodbtypes.AttributeValueMemberS).Value == "moved@example.com" &&
+			put.Item["id"].(*dynamodbtypes.AttributeValueMemberS).Value == "1" &&
+			*put.ConditionExpression == "attribute_not_exists(email)"
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil).Once()
+	// A pending duplicate of a confirmed subscriber is only removed.
+	db.On("TransactWriteItems", mock.Anything, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		return moving("Dup@Example.com")(in) && len(in.TransactItems) == 1
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil).Once()
+	db.On("TransactWriteItems", mock.Anything, mock.MatchedBy(moving("Busy@Example.com"))).Return(
+		&dynamodb.TransactWriteItemsOutput{}, &dynamodbtypes.TransactionCanceledException{Message: aws.String("changed")}).Once()
+
+	var out bytes.Buffer
+	err := runMigrateEmails(context.Background(), &ServiceClients{DynamoDB: db}, nil, &out)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "moved: 1\nmerged: 1\nchanged during migration: 1\ninvalid: 1\n  not an address\n", out.String())
+	db.AssertExpectations(t)
+}
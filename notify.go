@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Types of owner notification.
+const (
+	ownerEventConfirmed    = "confirmed"
+	ownerEventUnsubscribed = "unsubscribed"
+)
+
+// Digests are kept in the subscriber table, one item per UTC day, under a key
+// that can't be an email address. They have no confirm attribute, so they are
+// never sent mail, and they expire a week after their day.
+const (
+	digestKeyPrefix = "digest#"
+	digestDayLayout = "2006-01-02"
+	digestTTL       = 7 * 24 * time.Hour
+)
+
+// ownerEvent is something the list owner is told about.
+type ownerEvent struct {
+	Type  string    `dynamodbav:"type" json:"type"`
+	Email string    `dynamodbav:"email" json:"email"`
+	Time  time.Time `dynamodbav:"time" json:"time"`
+}
+
+// Notifier tells the list owner about people joining and leaving the list.
+type Notifier interface {
+	Notify(ctx context.Context, events []ownerEvent) error
+}
+
+// notifier is replaced in main according to NOTIFY_BACKEND.
+var notifier Notifier = noopNotifier{}
+
+// Create the Notifier named by backend: "email", "webhook", "slack", or "none".
+// If NOTIFY_DIGEST is true, events are saved and sent once a day instead.
+func newNotifier(backend string, clients *ServiceClients) Notifier {
+	var n Notifier
+	switch backend {
+	case "email":
+		n = emailNotifier{ses: clients.SES, to: os.Getenv("SENDER_EMAIL")}
+	case "webhook":
+		n = webhookNotifier{url: os.Getenv("NOTIFY_WEBHOOK_URL")}
+	case "slack":
+		n = slackNotifier{url: os.Getenv("NOTIFY_WEBHOOK_URL")}
+	default:
+		return noopNotifier{}
+	}
+	if digest, _ := strconv.ParseBool(os.Getenv("NOTIFY_DIGEST")); digest {
+		return &digestNotifier{db: clients.DynamoDB, next: n}
+	}
+	return n
+}
+
+// Tell the list owner about an event. A failure is logged but doesn't affect
+// the subscriber's request.
+func notifyOwner(ctx context.Context, eventType string, email string) {
+	event := ownerEvent{Type: eventType, Email: email, Time: clock().UTC()}
+	ctx, cancel := withTimeout(ctx, "NOTIFY_TIMEOUT", 5*time.Second)
+	defer cancel()
+	if err := notifier.Notify(ctx, []ownerEvent{event}); err != nil {
+		loggerFrom(ctx).Warn("could not notify owner", "error", err, "type", eventType)
+	}
+}
+
+// Describe events as a subject line and a plain text list, one event per line.
+func summarizeEvents(events []ownerEvent) (string, string) {
+	var confirmed, unsubscribed int
+	var b strings.Builder
+	for _, e := range events {
+		switch e.Type {
+		case ownerEventConfirmed:
+			confirmed++
+		case ownerEventUnsubscribed:
+			unsubscribed++
+		}
+		fmt.Fprintf(&b, "%s %s at %s\n", e.Email, e.Type, e.Time.UTC().Format(time.RFC3339))
+	}
+	if len(events) == 1 {
+		return fmt.Sprintf("%s %s", events[0].Email, events[0].Type), b.String()
+	}
+	return fmt.Sprintf("%d confirmed, %d unsubscribed", confirmed, unsubscribed), b.String()
+}
+
+// noopNotifier discards everything.
+type noopNotifier struct{}
+
+func (noopNotifier) Notify(context.Context, []ownerEvent) error { return nil }
+
+// emailNotifier emails the owner through SES.
+type emailNotifier struct {
+	ses SESAPI
+	to  string
+}
+
+func (n emailNotifier) Notify(ctx context.Context, events []ownerEvent) error {
+	subject, text := summarizeEvents(events)
+	body := "<p>" + strings.ReplaceAll(html.EscapeString(strings.TrimSpace(text)), "\n", "<br>\n") + "</p>"
+	_, err := sendMessageWithSES(ctx, n.ses, n.to, "Simple Subscribe: "+subject, body, text)
+	return err
+}
+
+// webhookNotifier posts events as JSON: {"events": [{"type", "email", "time"}, ...]}.
+type webhookNotifier struct {
+	url string
+}
+
+func (n webhookNotifier) Notify(ctx context.Context, events []ownerEvent) error {
+	return postJSON(ctx, n.url, map[string][]ownerEvent{"events": events})
+}
+
+// slackNotifier posts a message to a Slack incoming webhook, or any service
+// that accepts the same {"text": ...} payload.
+type slackNotifier struct {
+	url string
+}
+
+func (n slackNotifier) Notify(ctx context.Context, events []ownerEvent) error {
+	subject, text := summarizeEvents(events)
+	if len(events) == 1 {
+		return postJSON(ctx, n.url, map[string]string{"text": subject})
+	}
+	return postJSON(ctx, n.url, map[string]string{"text": subject + "\n" + text})
+}
+
+// POST v as JSON to url, treating any status other than 2xx as an error.
+func postJSON(ctx context.Context, url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return postBody(ctx, url, body, nil)
+}
+
+// POST a JSON body to url with any extra headers, treating any status other
+// than 2xx as an error.
+func postBody(ctx context.Context, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// digestNotifier saves events to the table so they can be sent to next as one
+// daily digest by the scheduled "digest" job.
+type digestNotifier struct {
+	db   DynamoDBAPI
+	next Notifier
+}
+
+func (n *digestNotifier) Notify(ctx context.Context, events []ownerEvent) error {
+	list, err := attributevalue.MarshalList(events)
+	if err != nil {
+		return err
+	}
+	day := events[0].Time.UTC().Truncate(24 * time.Hour)
+	input := &dynamodb.UpdateItemInput{
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"email": &dynamodbtypes.AttributeValueMemberS{Value: digestKeyPrefix + day.Format(digestDayLayout)},
+		},
+		ExpressionAttributeNames: map[string]string{
+			"#EV": "events",
+			"#E":  "expires_at",
+		},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":events": &dynamodbtypes.AttributeValueMemberL{Value: list},
+			":empty":  &dynamodbtypes.AttributeValueMemberL{Value: []dynamodbtypes.AttributeValue{}},
+			":expval": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(day.Add(digestTTL).Unix(), 10)},
+		},
+		UpdateExpression: aws.String("SET #EV = list_append(if_not_exists(#EV, :empty), :events), #E = :expval"),
+		TableName:        aws.String(os.Getenv("DB_TABLE_NAME")),
+	}
+
+	ctx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "DynamoDB", "UpdateItem")
+	defer span.End()
+	defer observeBackend("UpdateItem", time.Now())
+	if _, err := n.db.UpdateItem(ctx, input); err != nil {
+		recordSpanError(span, err)
+		return err
+	}
+	return nil
+}
+
+// Send the digest for the UTC day containing day, then delete it. A day with
+// no events sends nothing.
+func (n *digestNotifier) flush(ctx context.Context, day time.Time) (int, error) {
+	key := map[string]dynamodbtypes.AttributeValue{
+		"email": &dynamodbtypes.AttributeValueMemberS{Value: digestKeyPrefix + day.UTC().Format(digestDayLayout)},
+	}
+	table := aws.String(os.Getenv("DB_TABLE_NAME"))
+
+	getCtx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+	defer cancel()
+	result, err := n.db.GetItem(getCtx, &dynamodb.GetItemInput{Key: key, TableName: table})
+	if err != nil {
+		return 0, err
+	}
+	var digest struct {
+		Events []ownerEvent `dynamodbav:"events"`
+	}
+	if err := attributevalue.UnmarshalMap(result.Item, &digest); err != nil {
+		return 0, err
+	}
+	if len(digest.Events) == 0 {
+		return 0, nil
+	}
+
+	if err := n.next.Notify(ctx, digest.Events); err != nil {
+		return 0, err
+	}
+
+	delCtx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+	defer cancel()
+	if _, err := n.db.DeleteItem(delCtx, &dynamodb.DeleteItemInput{Key: key, TableName: table}); err != nil {
+		return len(digest.Events), err
+	}
+	return len(digest.Events), nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// recordingNotifier keeps the events it is given.
+type recordingNotifier struct {
+	events []ownerEvent
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, events []ownerEvent) error {
+	n.events = append(n.events, events...)
+	return nil
+}
+
+var testEvents = []ownerEvent{
+	{Type: ownerEventConfirmed, Email: "a@example.com", Time: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)},
+	{Type: ownerEventUnsubscribed, Email: "b@example.com", Time: time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC)},
+}
+
+func TestSummarizeEvents(t *testing.T) {
+	subject, text := summarizeEvents(testEvents[:1])
+	assert.Equal(t, "a@example.com confirmed", subject)
+	assert.Equal(t, "a@example.com confirmed at 2024-06-01T12:00:00Z\n", text)
+
+	subject, text = summarizeEvents(testEvents)
+	assert.Equal(t, "1 confirmed, 1 unsubscribed", subject)
+	assert.Equal(t, "a@example.com confirmed at 2024-06-01T12:00:00Z\nb@example.com unsubscribed at 2024-06-01T13:00:00Z\n", text)
+}
+
+func TestWebhookNotifiers(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	assert.NoError(t, webhookNotifier{url: server.URL}.Notify(context.Background(), testEvents[:1]))
+	assert.JSONEq(t, `{"events":[{"type":"confirmed","email":"a@example.com","time":"2024-06-01T12:00:00Z"}]}`, string(body))
+
+	assert.NoError(t, slackNotifier{url: server.URL}.Notify(context.Background(), testEvents[:1]))
+	assert.JSONEq(t, `{"text":"a@example.com confirmed"}`, string(body))
+
+	err := webhookNotifier{url: server.URL + "/fail"}.Notify(context.Background(), testEvents)
+	assert.ErrorContains(t, err, "500")
+}
+
+func TestEmailNotifier(t *testing.T) {
+	mockSES := new(MockSESClient)
+	mockSES.On("SendEmail", mock.Anything, mock.MatchedBy(func(in *ses.SendEmailInput) bool {
+		return in.Destination.ToAddresses[0] == "owner@example.com" && *in.Message.Subject.Data == "Simple Subscribe: 1 confirmed, 1 unsubscribed"
+	})).Return(&ses.SendEmailOutput{}, nil).Once()
+
+	err := emailNotifier{ses: mockSES, to: "owner@example.com"}.Notify(context.Background(), testEvents)
+
+	assert.NoError(t, err)
+	mockSES.AssertExpectations(t)
+}
+
+func TestDigestNotifier(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	dayKey := func(key map[string]dynamodbtypes.AttributeValue) bool {
+		return key["email"].(*dynamodbtypes.AttributeValueMemberS).Value == "digest#2024-06-01"
+	}
+
+	t.Run("Events are appended to the day's digest", func(t *testing.T) {
+		mockDynamoDB := new(MockDynamoDBClient)
+		mockDynamoDB.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+			return dayKey(in.Key) && len(in.ExpressionAttributeValues[":events"].(*dynamodbtypes.AttributeValueMemberL).Value) == 1
+		})).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+		next := &recordingNotifier{}
+
+		err := (&digestNotifier{db: mockDynamoDB, next: next}).Notify(context.Background(), testEvents[:1])
+
+		assert.NoError(t, err)
+		assert.Empty(t, next.events)
+		mockDynamoDB.AssertExpectations(t)
+	})
+
+	t.Run("Flush sends and deletes the digest", func(t *testing.T) {
+		list, err := attributevalue.MarshalList(testEvents)
+		assert.NoError(t, err)
+		mockDynamoDB := new(MockDynamoDBClient)
+		mockDynamoDB.On("GetItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+			return dayKey(in.Key)
+		})).Return(&dynamodb.GetItemOutput{Item: map[string]dynamodbtypes.AttributeValue{
+			"events": &dynamodbtypes.AttributeValueMemberL{Value: list},
+		}}, nil).Once()
+		mockDynamoDB.On("DeleteItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.DeleteItemInput) bool {
+			return dayKey(in.Key)
+		})).Return(&dynamodb.DeleteItemOutput{}, nil).Once()
+		next := &recordingNotifier{}
+
+		sent, err := (&digestNotifier{db: mockDynamoDB, next: next}).flush(context.Background(), testEvents[0].Time)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, sent)
+		assert.Equal(t, testEvents, next.events)
+		mockDynamoDB.AssertExpectations(t)
+	})
+
+	t.Run("Flush with no digest sends nothing", func(t *testing.T) {
+		mockDynamoDB := new(MockDynamoDBClient)
+		mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{}, nil).Once()
+		next := &recordingNotifier{}
+
+		sent, err := (&digestNotifier{db: mockDynamoDB, next: next}).flush(context.Background(), testEvents[0].Time)
+
+		assert.NoError(t, err)
+		assert.Zero(t, sent)
+		assert.Empty(t, next.events)
+	})
+}
+
+func TestHandlerNotifiesOwner(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	os.Setenv("UNSUBSCRIBE_PATH", "unsubscribe")
+	recorder := &recordingNotifier{}
+	notifier = recorder
+	defer func() { notifier = noopNotifier{} }()
+
+	mockDynamoDB := new(MockDynamoDBClient)
+	mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{
+		Item: subscriberItem("test@example.com", "123", true, "2024-01-01 00:00:00"),
+	}, nil).Once()
+	mockDynamoDB.On("TransactWriteItems", mock.Anything, mock.AnythingOfType("*dynamodb.TransactWriteItemsInput")).Return(&dynamodb.TransactWriteItemsOutput{}, nil).Once()
+
+	_, err := lambdaHandler(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB}, events.APIGatewayV2HTTPRequest{
+		RawPath:               "/unsubscribe/",
+		QueryStringParameters: map[string]string{"email": "test@example.com", "id": "123"},
+	})
+
+	assert.NoError(t, err)
+	if assert.Len(t, recorder.events, 1) {
+		assert.Equal(t, ownerEventUnsubscribed, recorder.events[0].Type)
+		assert.Equal(t, "test@example.com", recorder.events[0].Email)
+	}
+}
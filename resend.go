@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Defaults for how soon a confirmation email can be sent again, and how many
+// times in all.
+const (
+	defaultResendCooldown = 10 * time.Minute
+	defaultResendMax      = 3
+)
+
+// Read the wait between resends from RESEND_COOLDOWN, e.g. "15m".
+func resendCooldown() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("RESEND_COOLDOWN")); err == nil && d > 0 {
+		return d
+	}
+	return defaultResendCooldown
+}
+
+// Read the most resends a pending subscriber can have from RESEND_MAX.
+func resendMax() int {
+	if n, err := strconv.Atoi(os.Getenv("RESEND_MAX")); err == nil && n >= 0 {
+		return n
+	}
+	return defaultResendMax
+}
+
+// Send the confirmation email again to a pending subscriber whose link hasn't
+// expired, with the same id, unless they are within the cooldown or have had
+// the most resends allowed. Reports whether an email was sent. Nothing
+// different happens for an address with no item, so callers can't tell.
+func resendConfirmation(ctx context.Context, clients *ServiceClients, email string) (bool, error) {
+	sub, err := getSubscriber(ctx, clients.DynamoDB, email)
+	if err != nil {
+		return false, err
+	}
+	now := clock()
+	if !awaitingConfirmation(sub, now) {
+		return false, nil
+	}
+	return resendToPending(ctx, clients, sub, now)
+}
+
+// Report whether sub is a pending subscriber whose link hasn't expired.
+func awaitingConfirmation(sub *subscriber, now time.Time) bool {
+	return sub != nil && !sub.Confirm && !sub.expired(now)
+}
+
+// Send the confirmation email again to a pending subscriber, with the same id,
+// if the cooldown and limit allow it. Reports whether an email was sent.
+func resendToPending(ctx context.Context, clients *ServiceClients, sub *subscriber, now time.Time) (bool, error) {
+	claimed, err := claimResend(ctx, clients.DynamoDB, sub, now)
+	if err != nil || !claimed {
+		return false, err
+	}
+	if _, err := sendEmailWithSES(ctx, clients.SES, sub.Email, sub.ID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Count a resend on a pending item, if the item still has the same id and the
+// cooldown and limit allow it. The check and the count are one conditional
+// update, so concurrent requests can't both send. Reports whether the resend
+// was counted.
+func claimResend(ctx context.Context, svc DynamoDBAPI, sub *subscriber, now time.Time) (bool, error) {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv("DB_TABLE_NAME")),
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"email": &dynamodbtypes.AttributeValueMemberS{Value: sub.Email},
+		},
+		ExpressionAttributeNames: map[string]string{
+			"#ID": "id",
+			"#C":  "confirm",
+			"#RC": "resend_count",
+			"#RA": "resent_at",
+			"#U":  "updated_at",
+			"#E":  "expires_at",
+		},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":idval":  &dynamodbtypes.AttributeValueMemberS{Value: sub.ID},
+			":false":  &dynamodbtypes.AttributeValueMemberBOOL{Value: false},
+			":zero":   &dynamodbtypes.AttributeValueMemberN{Value: "0"},
+			":one":    &dynamodbtypes.AttributeValueMemberN{Value: "1"},
+			":max":    &dynamodbtypes.AttributeValueMemberN{Value: strconv.Itoa(resendMax())},
+			":nowval": &dynamodbtypes.AttributeValueMemberS{Value: formatTime(now)},
+			":expval": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(pendingTTL()).Unix(), 10)},
+			// RFC 3339 times in UTC sort as strings.
+			":cutoff": &dynamodbtypes.AttributeValueMemberS{Value: formatTime(now.Add(-resendCooldown()))},
+		},
+		// The link that is sent again is good for as long as a new one, so
+		// cleanup and the TTL have to wait as long before removing it.
+		UpdateExpression: aws.String("SET #RC = if_not_exists(#RC, :zero) + :one, #RA = :nowval, #U = :nowval, #E = :expval"),
+		ConditionExpression: aws.String("#ID = :idval AND #C = :false" +
+			" AND (attribute_not_exists(#RC) OR #RC < :max)" +
+			// Before the first resend, the wait is from the first send.
+			" AND (#RA <= :cutoff OR (attribute_not_exists(#RA) AND (attribute_not_exists(#U) OR #U <= :cutoff)))"),
+	}
+
+	ctx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "DynamoDB", "UpdateItem")
+	defer span.End()
+	defer observeBackend("UpdateItem", time.Now())
+	_, err := svc.UpdateItem(ctx, input)
+	var denied *dynamodbtypes.ConditionalCheckFailedException
+	if errors.As(err, &denied) {
+		return false, nil
+	}
+	if err != nil {
+		recordSpanError(span, err)
+		loggerFrom(ctx).Error("could not count resend", "error", err, logKeyEmail, sub.Email)
+		return false, err
+	}
+	return true, nil
+}
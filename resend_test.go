@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestResendConfirmation(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	defer func(c func() time.Time) { clock = c }(clock)
+	clock = func() time.Time { return time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC) }
+
+	pending := subscriberItem("a@example.com", "1", false, "2024-06-01 11:00:00")
+	pending["expires_at"] = &dynamodbtypes.AttributeValueMemberN{Value: "1717848000"}
+	expired := subscriberItem("a@example.com", "1", false, "2024-05-01 11:00:00")
+	expired["expires_at"] = &dynamodbtypes.AttributeValueMemberN{Value: "1714568400"}
+
+	tests := []struct {
+		name         string
+		item         map[string]dynamodbtypes.AttributeValue
+		expectUpdate bool
+		updateErr    error
+		expectSend   bool
+	}{
+		{name: "No item"},
+		{name: "Confirmed", item: subscriberItem("a@example.com", "1", true, "2024-06-01 11:00:00")},
+		{name: "Expired", item: expired},
+		{name: "Pending", item: pending, expectUpdate: true, expectSend: true},
+		{
+			name:         "Cooldown or limit reached",
+			item:         pending,
+			expectUpdate: true,
+			updateErr:    &dynamodbtypes.ConditionalCheckFailedException{Message: aws.String("denied")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDynamoDB := new(MockDynamoDBClient)
+			mockSES := new(MockSESClient)
+			mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{Item: tt.item}, nil).Once()
+			if tt.expectUpdate {
+				mockDynamoDB.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+					return *in.UpdateExpression == "SET #RC = if_not_exists(#RC, :zero) + :one, #RA = :nowval, #U = :nowval, #E = :expval" &&
+						*in.ConditionExpression == "#ID = :idval AND #C = :false AND (attribute_not_exists(#RC) OR #RC < :max) AND (#RA <= :cutoff OR (attribute_not_exists(#RA) AND (attribute_not_exists(#U) OR #U <= :cutoff)))" &&
+						in.ExpressionAttributeValues[":idval"].(*dynamodbtypes.AttributeValueMemberS).Value == "1" &&
+						in.ExpressionAttributeValues[":max"].(*dynamodbtypes.AttributeValueMemberN).Value == "3" &&
+						in.ExpressionAttributeValues[":cutoff"].(*dynamodbtypes.AttributeValueMemberS).Value == "2024-06-01T11:50:00Z" &&
+						// The resent link is good for another PENDING_TTL.
+						in.ExpressionAttributeValues[":expval"].(*dynamodbtypes.AttributeValueMemberN).Value == "1717848000"
+				})).Return(&dynamodb.UpdateItemOutput{}, tt.updateErr).Once()
+			}
+			if tt.expectSend {
+				// The link keeps the pending item's id.
+				mockSES.On("SendEmail", mock.Anything, mock.MatchedBy(func(in *ses.SendEmailInput) bool {
+					return in.Destination.ToAddresses[0] == "a@example.com" &&
+						strings.Contains(*in.Message.Body.Text.Data, "id=1")
+				})).Return(&ses.SendEmailOutput{}, nil).Once()
+			}
+
+			sent, err := resendConfirmation(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB, SES: mockSES}, "a@example.com")
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectSend, sent)
+			mockDynamoDB.AssertExpectations(t)
+			mockSES.AssertExpectations(t)
+		})
+	}
+}
+
+func TestResendSameResponse(t *testing.T) {
+	os.Setenv("BASE_URL", "https://example.com")
+	os.Setenv("CONFIRM_SUBSCRIBE_PAGE", "/confirm-subscribe")
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	os.Setenv("RESEND_PATH", "resend")
+	defer os.Unsetenv("RESEND_PATH")
+
+	pending := subscriberItem("a@example.com", "1", false, "2024-06-01 11:00:00")
+
+	for _, item := range []map[string]dynamodbtypes.AttributeValue{nil, pending} {
+		mockDynamoDB := new(MockDynamoDBClient)
+		mockSES := new(MockSESClient)
+		mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{Item: item}, nil).Once()
+		mockDynamoDB.On("UpdateItem", mock.Anything, mock.AnythingOfType("*dynamodb.UpdateItemInput")).Return(&dynamodb.UpdateItemOutput{}, nil).Maybe()
+		mockSES.On("SendEmail", mock.Anything, mock.AnythingOfType("*ses.SendEmailInput")).Return(&ses.SendEmailOutput{}, nil).Maybe()
+
+		resp, err := lambdaHandler(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB, SES: mockSES}, events.APIGatewayV2HTTPRequest{
+			RawPath:               "/resend/",
+			QueryStringParameters: map[string]string{"email": "a@example.com"},
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 303, resp.StatusCode)
+		assert.Equal(t, "https://example.com/confirm-subscribe", resp.Headers["Location"])
+		mockDynamoDB.AssertExpectations(t)
+	}
+}
+
+func TestSubscribeWhilePendingResends(t *testing.T) {
+	os.Setenv("BASE_URL", "https://example.com")
+	os.Setenv("CONFIRM_SUBSCRIBE_PAGE", "/confirm-subscribe")
+	os.Setenv("SUBSCRIBE_PATH", "subscribe")
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	defer func(c func() time.Time) { clock = c }(clock)
+	clock = func() time.Time { return time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC) }
+
+	pending := subscriberItem("a@example.com", "1", false, "2024-06-01 11:00:00")
+	pending["expires_at"] = &dynamodbtypes.AttributeValueMemberN{Value: "1717848000"}
+
+	tests := []struct {
+		name       string
+		updateErr  error
+		expectSend bool
+	}{
+		{name: "Allowed", expectSend: true},
+		{name: "Cooldown or limit reached", updateErr: &dynamodbtypes.ConditionalCheckFailedException{Message: aws.String("denied")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDynamoDB := new(MockDynamoDBClient)
+			mockSES := new(MockSESClient)
+			mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{Item: pending}, nil).Once()
+			// The request counts as a resend rather than starting over with a
+			// new id.
+			mockDynamoDB.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+				return *in.UpdateExpression == "SET #RC = if_not_exists(#RC, :zero) + :one, #RA = :nowval, #U = :nowval, #E = :expval"
+			})).Return(&dynamodb.UpdateItemOutput{}, tt.updateErr).Once()
+			if tt.expectSend {
+				mockSES.On("SendEmail", mock.Anything, mock.MatchedBy(func(in *ses.SendEmailInput) bool {
+					return strings.Contains(*in.Message.Body.Text.Data, "id=1")
+				})).Return(&ses.SendEmailOutput{}, nil).Once()
+			}
+
+			resp, err := lambdaHandler(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB, SES: mockSES}, events.APIGatewayV2HTTPRequest{
+				RawPath:               "/subscribe/",
+				QueryStringParameters: map[string]string{"email": "a@example.com"},
+			})
+
+			assert.NoError(t, err)
+			assert.Equal(t, "https://example.com/confirm-subscribe", resp.Headers["Location"])
+			mockDynamoDB.AssertExpectations(t)
+			mockSES.AssertExpectations(t)
+		})
+	}
+}
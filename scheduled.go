@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// scheduledDetail is the optional detail of a scheduled event. Set it with the
+// rule's input to choose a job, "cleanup", "feed", "digest", or "outbox"; an
+// empty detail runs the cleanup job.
+type scheduledDetail struct {
+	Job string `json:"job"`
+}
+
+// Run the job named in an EventBridge scheduled event.
+func scheduledHandler(ctx context.Context, clients *ServiceClients, event events.EventBridgeEvent) error {
+	var detail scheduledDetail
+	if len(event.Detail) > 0 {
+		if err := json.Unmarshal(event.Detail, &detail); err != nil {
+			return fmt.Errorf("could not read scheduled event detail: %w", err)
+		}
+	}
+	if detail.Job == "" {
+		detail.Job = "cleanup"
+	}
+
+	log := logger.With(slog.String("event_id", event.ID), slog.String("job", detail.Job))
+	ctx = withLogger(ctx, log)
+
+	switch detail.Job {
+	case "cleanup":
+		_, err := cleanupPendingSubscriptions(ctx, clients.DynamoDB, cleanupConfigFromEnv(), clock())
+		return err
+	case "feed":
+		feedURL := os.Getenv("FEED_URL")
+		if feedURL == "" {
+			return errors.New("FEED_URL is not set")
+		}
+		n, err := loadFeedTemplates(os.Getenv("FEED_HTML_TEMPLATE"), os.Getenv("FEED_TEXT_TEMPLATE"))
+		if err != nil {
+			return err
+		}
+		_, err = mailFeed(ctx, clients, feedURL, n, false)
+		return err
+	case "digest":
+		digest, ok := notifier.(*digestNotifier)
+		if !ok {
+			return errors.New("NOTIFY_DIGEST is not enabled")
+		}
+		sent, err := digest.flush(ctx, clock().UTC().AddDate(0, 0, -1))
+		log.Info("sent owner digest", "events", sent)
+		return err
+	case "outbox":
+		delivered, failed, err := retryWebhookOutbox(ctx, clients.DynamoDB, clock())
+		log.Info("retried webhook outbox", "delivered", delivered, "failed", failed)
+		return err
+	}
+	return fmt.Errorf("unknown scheduled job: %s", detail.Job)
+}
+
+// Route a raw Lambda payload to the handler for its event source: records
+// from the table's DynamoDB stream, scheduled events from EventBridge, or HTTP
+// requests from API Gateway.
+func handleEvent(ctx context.Context, clients *ServiceClients, payload json.RawMessage) (any, error) {
+	var probe struct {
+		DetailType string `json:"detail-type"`
+		Records    []struct {
+			EventSource string `json:"eventSource"`
+		} `json:"Records"`
+	}
+	if err := json.Unmarshal(payload, &probe); err != nil {
+		return nil, err
+	}
+
+	if len(probe.Records) > 0 && probe.Records[0].EventSource == "aws:dynamodb" {
+		var event events.DynamoDBEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		return streamHandler(ctx, eventSinks, event)
+	}
+
+	if probe.DetailType == "Scheduled Event" {
+		var event events.EventBridgeEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		return nil, scheduledHandler(ctx, clients, event)
+	}
+
+	var event events.APIGatewayV2HTTPRequest
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	return lambdaHandler(ctx, clients, event)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestHandleEvent(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	os.Setenv("BASE_URL", "https://example.com")
+	os.Setenv("ERROR_PAGE", "/error")
+
+	t.Run("Scheduled event runs cleanup", func(t *testing.T) {
+		mockDynamoDB := new(MockDynamoDBClient)
+		mockDynamoDB.On("Scan", mock.Anything, mock.AnythingOfType("*dynamodb.ScanInput")).Return(&dynamodb.ScanOutput{}, nil).Once()
+
+		payload := json.RawMessage(`{"id":"evt-1","detail-type":"Scheduled Event","source":"aws.events","detail":{}}`)
+		result, err := handleEvent(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB}, payload)
+
+		assert.NoError(t, err)
+		assert.Nil(t, result)
+		mockDynamoDB.AssertExpectations(t)
+	})
+
+	t.Run("Scheduled cleanup measures age from the clock", func(t *testing.T) {
+		defer func(c func() time.Time) { clock = c }(clock)
+		clock = func() time.Time { return time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC) }
+		mockDynamoDB := new(MockDynamoDBClient)
+		mockDynamoDB.On("Scan", mock.Anything, mock.AnythingOfType("*dynamodb.ScanInput")).Return(&dynamodb.ScanOutput{
+			Items: []map[string]dynamodbtypes.AttributeValue{
+				subscriberItem("a@example.com", "1", false, "2024-06-01 00:00:00"),
+			},
+		}, nil).Once()
+
+		payload := json.RawMessage(`{"detail-type":"Scheduled Event","detail":{"job":"cleanup"}}`)
+		_, err := handleEvent(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB}, payload)
+
+		// Two days old is within the default week, so nothing is deleted.
+		assert.NoError(t, err)
+		mockDynamoDB.AssertExpectations(t)
+		mockDynamoDB.AssertNotCalled(t, "DeleteItem", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Unknown scheduled job", func(t *testing.T) {
+		payload := json.RawMessage(`{"detail-type":"Scheduled Event","detail":{"job":"samba"}}`)
+		_, err := handleEvent(context.Background(), &ServiceClients{}, payload)
+
+		assert.ErrorContains(t, err, "unknown scheduled job: samba")
+	})
+
+	t.Run("HTTP request goes to lambdaHandler", func(t *testing.T) {
+		payload := json.RawMessage(`{"version":"2.0","rawPath":"/unknown/"}`)
+		result, err := handleEvent(context.Background(), &ServiceClients{}, payload)
+
+		assert.NoError(t, err)
+		resp := result.(events.APIGatewayV2HTTPResponse)
+		assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+		assert.Equal(t, "https://example.com/error", resp.Headers["Location"])
+	})
+}
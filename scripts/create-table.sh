@@ -12,3 +12,9 @@ aws dynamodb create-table \
     --key-schema \
         AttributeName=email,KeyType=HASH \
     --provisioned-throughput ReadCapacityUnits=5,WriteCapacityUnits=5
+
+echo "Enabling TTL for pending subscriptions..."
+aws dynamodb wait table-exists --table-name ${BUILD_TABLE_NAME}
+aws dynamodb update-time-to-live \
+    --table-name ${BUILD_TABLE_NAME} \
+    --time-to-live-specification Enabled=true,AttributeName=expires_at
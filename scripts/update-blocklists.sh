@@ -0,0 +1,14 @@
+#!/bin/bash
+# Replace the embedded disposable-domain list with the latest community list.
+# Rebuild and deploy afterwards to pick up the change.
+
+set -euo pipefail
+
+URL="https://raw.githubusercontent.com/disposable-email-domains/disposable-email-domains/main/disposable_email_blocklist.conf"
+OUT="$(dirname "$0")/../blocklists/disposable_domains.txt"
+
+{
+  head -n 3 "$OUT"
+  curl -fsSL "$URL"
+} > "$OUT.tmp"
+mv "$OUT.tmp" "$OUT"
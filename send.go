@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"os"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+)
+
+// newsletter is one message to send to every confirmed subscriber.
+type newsletter struct {
+	Subject string
+	HTML    *htmltemplate.Template
+	Text    *texttemplate.Template
+	// The feed item the message is about, for feed campaigns.
+	Item *feedItem
+}
+
+// newsletterData is what templates can use when rendering a message for one subscriber.
+type newsletterData struct {
+	Email          string
+	ID             string
+	UnsubscribeURL string
+	Fields         map[string]string
+	Item           *feedItem
+}
+
+// sendReport describes the outcome of sending a newsletter.
+type sendReport struct {
+	Sent      int
+	Skipped   int
+	Failed    int
+	Uncertain []string
+}
+
+// Send a newsletter to confirmed subscribers.
+func runSend(ctx context.Context, clients *ServiceClients, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("send", flag.ContinueOnError)
+	subject := flags.String("subject", "", "subject line")
+	htmlPath := flags.String("html", "", "HTML template file")
+	textPath := flags.String("text", "", "plain text template file")
+	rate := flags.Float64("rate", 0, "messages to send per second (default: your SES maximum send rate)")
+	progressPath := flags.String("progress", "", "file recording who has been sent this newsletter (default: named after the newsletter's content)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *subject == "" || *htmlPath == "" || *textPath == "" {
+		return errors.New("usage: simple-subscribe send -subject <subject> -html <file> -text <file> [-rate n] [-progress file]")
+	}
+
+	htmlSrc, err := os.ReadFile(*htmlPath)
+	if err != nil {
+		return err
+	}
+	textSrc, err := os.ReadFile(*textPath)
+	if err != nil {
+		return err
+	}
+	n, err := parseNewsletter(*subject, string(htmlSrc), string(textSrc))
+	if err != nil {
+		return err
+	}
+
+	if *progressPath == "" {
+		sum := sha256.Sum256([]byte(*subject + "\x00" + string(htmlSrc) + "\x00" + string(textSrc)))
+		*progressPath = fmt.Sprintf("send-%s.progress", hex.EncodeToString(sum[:6]))
+	}
+	progress, err := openSendProgress(*progressPath)
+	if err != nil {
+		return err
+	}
+	defer progress.Close()
+
+	if *rate <= 0 {
+		*rate = sesSendRate(ctx, clients.SES)
+	}
+
+	report, err := sendNewsletter(ctx, clients, n, progress, *rate)
+	fmt.Fprintf(w, "sent: %d\nalready sent: %d\nfailed: %d\nprogress: %s\n", report.Sent, report.Skipped, report.Failed, *progressPath)
+	if len(report.Uncertain) > 0 {
+		fmt.Fprintf(w, "not sent because an earlier run stopped while sending to them: %s\n", strings.Join(report.Uncertain, ", "))
+	}
+	return err
+}
+
+// Parse the subject and the HTML and text templates of a newsletter.
+func parseNewsletter(subject string, html string, text string) (newsletter, error) {
+	// A custom field the subscriber didn't give renders as empty.
+	h, err := htmltemplate.New("html").Option("missingkey=zero").Parse(html)
+	if err != nil {
+		return newsletter{}, fmt.Errorf("could not parse HTML template: %w", err)
+	}
+	t, err := texttemplate.New("text").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return newsletter{}, fmt.Errorf("could not parse text template: %w", err)
+	}
+	return newsletter{Subject: subject, HTML: h, Text: t}, nil
+}
+
+// Render the HTML and text bodies of a newsletter for one subscriber.
+func (n newsletter) render(sub subscriber) (string, string, error) {
+	data := newsletterData{
+		Email:          sub.Email,
+		ID:             sub.ID,
+		UnsubscribeURL: unsubscribeURL(sub.Email, sub.ID),
+		Fields:         sub.Fields,
+		Item:           n.Item,
+	}
+	var html, text strings.Builder
+	if err := n.HTML.Execute(&html, data); err != nil {
+		return "", "", err
+	}
+	if err := n.Text.Execute(&text, data); err != nil {
+		return "", "", err
+	}
+	return html.String(), text.String(), nil
+}
+
+// Ask SES how many messages per second this account may send, falling back
+// to one per second if it can't be found.
+func sesSendRate(ctx context.Context, sesSvc SESAPI) float64 {
+	ctx, cancel := withTimeout(ctx, "SES_TIMEOUT", defaultSESTimeout)
+	defer cancel()
+	quota, err := sesSvc.GetSendQuota(ctx, &ses.GetSendQuotaInput{})
+	if err != nil || quota.MaxSendRate <= 0 {
+		loggerFrom(ctx).Warn("could not get SES send rate, sending one message per second", "error", err)
+		return 1
+	}
+	return quota.MaxSendRate
+}
+
+// Send a newsletter to each confirmed subscriber that progress doesn't show
+// as already sent, at no more than rate messages per second. With a nil
+// progress, every confirmed subscriber is sent the newsletter.
+func sendNewsletter(ctx context.Context, clients *ServiceClients, n newsletter, progress *sendProgress, rate float64) (sendReport, error) {
+	var report sendReport
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+
+	err := scanSubscribersByConfirm(ctx, clients.DynamoDB, true, func(sub subscriber) error {
+		switch progress.state(sub.Email) {
+		case progressDone:
+			report.Skipped++
+			return nil
+		case progressStarted:
+			// A previous run stopped between starting and finishing this send,
+			// so it may have been delivered. Don't risk sending it twice.
+			report.Uncertain = append(report.Uncertain, sub.Email)
+			return nil
+		}
+
+		html, text, err := n.render(sub)
+		if err != nil {
+			return fmt.Errorf("could not render newsletter for %s: %w", sub.Email, err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if err := progress.record(progressStarted, sub.Email); err != nil {
+			return err
+		}
+		if _, err := sendMessageWithSES(ctx, clients.SES, sub.Email, n.Subject, html, text); err != nil {
+			report.Failed++
+			// The send failed, so it is safe to try again in a later run.
+			return progress.record(progressFailed, sub.Email)
+		}
+		report.Sent++
+		return progress.record(progressDone, sub.Email)
+	})
+	return report, err
+}
+
+// States recorded in a send progress file.
+const (
+	progressStarted = "started"
+	progressDone    = "done"
+	progressFailed  = "failed"
+)
+
+// sendProgress is an append-only log of sends, so an interrupted run can be
+// resumed without sending anyone the same newsletter twice.
+type sendProgress struct {
+	f      *os.File
+	states map[string]string
+}
+
+// Open or create a progress file, reading the last recorded state of each address.
+func openSendProgress(path string) (*sendProgress, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	p := &sendProgress{f: f, states: make(map[string]string)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		state, email, ok := strings.Cut(scanner.Text(), "\t")
+		if ok {
+			p.states[email] = state
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Return the last recorded state for an address, or "" if there is none.
+func (p *sendProgress) state(email string) string {
+	if p == nil {
+		return ""
+	}
+	return p.states[email]
+}
+
+// Record a state for an address, syncing it to disk before returning.
+func (p *sendProgress) record(state string, email string) error {
+	if p == nil {
+		return nil
+	}
+	p.states[email] = state
+	if _, err := fmt.Fprintf(p.f, "%s\t%s\n", state, email); err != nil {
+		return err
+	}
+	return p.f.Sync()
+}
+
+func (p *sendProgress) Close() error {
+	return p.f.Close()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNewsletterRender(t *testing.T) {
+	os.Setenv("API_URL", "https://api.example.com/")
+	os.Setenv("UNSUBSCRIBE_PATH", "unsubscribe")
+
+	n, err := parseNewsletter("Hello",
+		`<p>Hi {{.Email}}</p><a href="{{.UnsubscribeURL}}">Unsubscribe</a>`,
+		"Hi {{.Email}}\nUnsubscribe: {{.UnsubscribeURL}}")
+	assert.NoError(t, err)
+
+	html, text, err := n.render(subscriber{Email: "a+b@example.com", ID: "123"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, `<p>Hi a&#43;b@example.com</p><a href="https://api.example.com/unsubscribe/?email=a%2Bb%40example.com&amp;id=123">Unsubscribe</a>`, html)
+	assert.Equal(t, "Hi a+b@example.com\nUnsubscribe: https://api.example.com/unsubscribe/?email=a%2Bb%40example.com&id=123", text)
+}
+
+func TestNewsletterRenderFields(t *testing.T) {
+	n, err := parseNewsletter("Hello",
+		`<p>Hi {{with .Fields.first_name}}{{.}}{{else}}there{{end}}</p>`,
+		"Hi {{.Fields.first_name}}")
+	assert.NoError(t, err)
+
+	html, text, err := n.render(subscriber{Email: "a@example.com", ID: "1", Fields: map[string]string{"first_name": "Ford"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "<p>Hi Ford</p>", html)
+	assert.Equal(t, "Hi Ford", text)
+
+	html, text, err = n.render(subscriber{Email: "a@example.com", ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "<p>Hi there</p>", html)
+	assert.Equal(t, "Hi ", text)
+}
+
+func TestParseNewsletterError(t *testing.T) {
+	_, err := parseNewsletter("Hello", "{{.Email", "")
+	assert.ErrorContains(t, err, "could not parse HTML template")
+}
+
+func TestSendNewsletter(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	path := filepath.Join(t.TempDir(), "send.progress")
+	assert.NoError(t, os.WriteFile(path, []byte("started\tdone@example.com\ndone\tdone@example.com\nstarted\tcrashed@example.com\nfailed\tretry@example.com\n"), 0o600))
+
+	mockDynamoDB := new(MockDynamoDBClient)
+	mockDynamoDB.On("Scan", mock.Anything, mock.AnythingOfType("*dynamodb.ScanInput")).Return(&dynamodb.ScanOutput{
+		Items: []map[string]dynamodbtypes.AttributeValue{
+			subscriberItem("done@example.com", "1", true, "2024-01-01 00:00:00"),
+			subscriberItem("crashed@example.com", "2", true, "2024-01-01 00:00:00"),
+			subscriberItem("retry@example.com", "3", true, "2024-01-01 00:00:00"),
+			subscriberItem("new@example.com", "4", true, "2024-01-01 00:00:00"),
+			subscriberItem("bounce@example.com", "5", true, "2024-01-01 00:00:00"),
+		},
+	}, nil).Once()
+	to := func(email string) any {
+		return mock.MatchedBy(func(in *ses.SendEmailInput) bool {
+			return in.Destination.ToAddresses[0] == email
+		})
+	}
+	mockSES := new(MockSESClient)
+	mockSES.On("SendEmail", mock.Anything, to("retry@example.com")).Return(&ses.SendEmailOutput{}, nil).Once()
+	mockSES.On("SendEmail", mock.Anything, to("new@example.com")).Return(&ses.SendEmailOutput{}, nil).Once()
+	mockSES.On("SendEmail", mock.Anything, to("bounce@example.com")).Return(&ses.SendEmailOutput{}, errors.New("ses error")).Once()
+
+	n, err := parseNewsletter("Hello", "<p>Hi</p>", "Hi")
+	assert.NoError(t, err)
+	progress, err := openSendProgress(path)
+	assert.NoError(t, err)
+
+	report, err := sendNewsletter(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB, SES: mockSES}, n, progress, 1000)
+	progress.Close()
+
+	assert.NoError(t, err)
+	assert.Equal(t, sendReport{Sent: 2, Skipped: 1, Failed: 1, Uncertain: []string{"crashed@example.com"}}, report)
+	mockDynamoDB.AssertExpectations(t)
+	mockSES.AssertExpectations(t)
+
+	// A second run picks up where the first left off.
+	reopened, err := openSendProgress(path)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, progressDone, reopened.state("new@example.com"))
+	assert.Equal(t, progressDone, reopened.state("retry@example.com"))
+	assert.Equal(t, progressFailed, reopened.state("bounce@example.com"))
+	assert.Equal(t, progressStarted, reopened.state("crashed@example.com"))
+
+	contents, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(contents), "started\tbounce@example.com\nfailed\tbounce@example.com\n"))
+}
+
+func TestSESSendRate(t *testing.T) {
+	mockSES := new(MockSESClient)
+	mockSES.On("GetSendQuota", mock.Anything, mock.Anything).Return(&ses.GetSendQuotaOutput{MaxSendRate: 14}, nil).Once()
+	mockSES.On("GetSendQuota", mock.Anything, mock.Anything).Return(&ses.GetSendQuotaOutput{}, errors.New("ses error")).Once()
+
+	assert.Equal(t, float64(14), sesSendRate(context.Background(), mockSES))
+	assert.Equal(t, float64(1), sesSendRate(context.Background(), mockSES))
+	mockSES.AssertExpectations(t)
+}
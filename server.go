@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+)
+
+// Run the handler as a long-lived HTTP server instead of a Lambda, e.g. for
+// local testing or running in a container. Prometheus metrics are served at /metrics.
+func runServer(clients *ServiceClients, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", envOrDefault("SERVER_ADDR", ":8080"), "address to listen on")
+	flags.Parse(args)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+	mux.Handle("/", serverHandler(clients))
+
+	logger.Info("listening", "addr", *addr)
+	return http.ListenAndServe(*addr, mux)
+}
+
+// Adapt lambdaHandler to net/http by translating requests into the API Gateway
+// payload format 2.0 events that Lambda would receive.
+func serverHandler(clients *ServiceClients) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, _ := lambdaHandler(r.Context(), clients, apiGatewayEvent(r))
+		for k, v := range resp.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write([]byte(resp.Body))
+	})
+}
+
+// Build an API Gateway HTTP API event from an HTTP request.
+func apiGatewayEvent(r *http.Request) events.APIGatewayV2HTTPRequest {
+	query := make(map[string]string)
+	for k, v := range r.URL.Query() {
+		query[k] = strings.Join(v, ",")
+	}
+	headers := make(map[string]string)
+	for k, v := range r.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		sourceIP = r.RemoteAddr
+	}
+	requestID := r.Header.Get("X-Request-Id")
+	if requestID == "" {
+		requestID = uuid.New().String()
+	}
+	return events.APIGatewayV2HTTPRequest{
+		Version:               "2.0",
+		RawPath:               r.URL.Path,
+		RawQueryString:        r.URL.RawQuery,
+		QueryStringParameters: query,
+		Headers:               headers,
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			RequestID: requestID,
+			HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				SourceIP:  sourceIP,
+				UserAgent: r.UserAgent(),
+			},
+		},
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIGatewayEvent(t *testing.T) {
+	r := httptest.NewRequest("GET", "/subscribe/?email=test%40example.com", nil)
+	r.RemoteAddr = "[2001:db8::1]:1234"
+	r.Header.Set("User-Agent", "test-agent")
+	r.Header.Set("X-Request-Id", "req-1")
+
+	event := apiGatewayEvent(r)
+
+	assert.Equal(t, "/subscribe/", event.RawPath)
+	assert.Equal(t, "email=test%40example.com", event.RawQueryString)
+	assert.Equal(t, "test@example.com", event.QueryStringParameters["email"])
+	assert.Equal(t, "test-agent", event.Headers["user-agent"])
+	assert.Equal(t, "req-1", event.RequestContext.RequestID)
+	assert.Equal(t, "2001:db8::1", event.RequestContext.HTTP.SourceIP)
+	assert.Equal(t, "GET", event.RequestContext.HTTP.Method)
+}
+
+func TestServerHandler(t *testing.T) {
+	os.Setenv("BASE_URL", "https://example.com")
+	os.Setenv("ERROR_PAGE", "/error")
+
+	w := httptest.NewRecorder()
+	serverHandler(&ServiceClients{}).ServeHTTP(w, httptest.NewRequest("GET", "/unknown/", nil))
+
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "https://example.com/error", w.Header().Get("Location"))
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	eventbridgetypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// Types of subscriber event found only in the table's stream.
+const (
+	streamSubscriberTokenRotated = "subscriber.token_rotated"
+	streamSubscriberExpired      = "subscriber.expired"
+)
+
+// Default limit for a single call to SNS or EventBridge.
+const defaultPublishTimeout = 5 * time.Second
+
+// eventSink is somewhere subscriber events from the table's stream are sent.
+type eventSink interface {
+	Publish(ctx context.Context, event webhookEvent) error
+}
+
+// eventSinks is replaced in main according to STREAM_SINKS.
+var eventSinks []eventSink
+
+// Create the sinks named in a comma-separated list of "log", "webhook", "sns",
+// and "eventbridge". Unknown names are skipped with a warning.
+func newEventSinks(names string, clients *ServiceClients) []eventSink {
+	var sinks []eventSink
+	for _, name := range strings.Split(names, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "log":
+			sinks = append(sinks, logSink{})
+		case "webhook":
+			if os.Getenv("WEBHOOK_SECRET") == "" {
+				logger.Error("not sending stream events to webhooks because WEBHOOK_SECRET is not set")
+				continue
+			}
+			for _, url := range webhookURLs() {
+				sinks = append(sinks, webhookSink{url: url})
+			}
+		case "sns":
+			sinks = append(sinks, snsSink{client: clients.SNS, topicARN: os.Getenv("SNS_TOPIC_ARN")})
+		case "eventbridge":
+			sinks = append(sinks, eventBridgeSink{client: clients.EventBridge, bus: envOrDefault("EVENT_BUS_NAME", "default")})
+		case "", "none":
+		default:
+			logger.Warn("unknown stream sink", "sink", name)
+		}
+	}
+	return sinks
+}
+
+// Turn the records of a DynamoDB stream into subscriber events and publish
+// each to every sink, in order. Processing stops at the first record that
+// can't be published, and it is reported as a batch item failure so Lambda
+// retries the stream from there. Sinks may see an event more than once, so
+// they should ignore repeated event ids.
+func streamHandler(ctx context.Context, sinks []eventSink, event events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+	var resp events.DynamoDBEventResponse
+	log := logger.With(slog.Int("records", len(event.Records)))
+	ctx = withLogger(ctx, log)
+
+	for _, record := range event.Records {
+		e, ok := subscriberEventFromRecord(record)
+		if !ok {
+			continue
+		}
+		for _, sink := range sinks {
+			if err := sink.Publish(ctx, e); err != nil {
+				log.Error("could not publish stream event", "error", err, "type", e.Type, "sink", fmt.Sprintf("%T", sink))
+				resp.BatchItemFailures = append(resp.BatchItemFailures, events.DynamoDBBatchItemFailure{
+					ItemIdentifier: record.Change.SequenceNumber,
+				})
+				return resp, nil
+			}
+		}
+	}
+	return resp, nil
+}
+
+// Interpret a stream record as a subscriber event. Records for items that
+// aren't subscribers, and changes that don't matter to other systems, like a
+// new timestamp, are skipped.
+func subscriberEventFromRecord(record events.DynamoDBEventRecord) (webhookEvent, bool) {
+	oldSub, hadOld := streamSubscriber(record.Change.OldImage)
+	newSub, hasNew := streamSubscriber(record.Change.NewImage)
+
+	var eventType, email string
+	switch events.DynamoDBOperationType(record.EventName) {
+	case events.DynamoDBOperationTypeInsert:
+		if !hasNew {
+			return webhookEvent{}, false
+		}
+		email = newSub.Email
+		eventType = webhookSubscriberPending
+		if newSub.Confirm {
+			eventType = webhookSubscriberConfirmed
+		}
+	case events.DynamoDBOperationTypeModify:
+		if !hasNew {
+			return webhookEvent{}, false
+		}
+		email = newSub.Email
+		switch {
+		case !hadOld || oldSub.Confirm != newSub.Confirm:
+			eventType = webhookSubscriberPending
+			if newSub.Confirm {
+				eventType = webhookSubscriberConfirmed
+			}
+		case oldSub.ID != newSub.ID:
+			eventType = streamSubscriberTokenRotated
+		default:
+			return webhookEvent{}, false
+		}
+	case events.DynamoDBOperationTypeRemove:
+		if !hadOld {
+			return webhookEvent{}, false
+		}
+		email = oldSub.Email
+		// A pending subscription is removed when it expires or is cleaned up.
+		eventType = streamSubscriberExpired
+		if oldSub.Confirm {
+			eventType = webhookSubscriberUnsubscribed
+		}
+	default:
+		return webhookEvent{}, false
+	}
+
+	createdAt := record.Change.ApproximateCreationDateTime.UTC()
+	if createdAt.IsZero() {
+		createdAt = clock().UTC()
+	}
+	return webhookEvent{
+		ID:        record.EventID,
+		Type:      eventType,
+		CreatedAt: createdAt,
+		Data:      webhookEventData{Email: email},
+	}, true
+}
+
+// Read the subscriber in a stream image. Images without a confirm attribute
+// are other kinds of item, like feed state or the webhook outbox.
+func streamSubscriber(image map[string]events.DynamoDBAttributeValue) (subscriber, bool) {
+	confirm, ok := image["confirm"]
+	if !ok || confirm.DataType() != events.DataTypeBoolean {
+		return subscriber{}, false
+	}
+	sub := subscriber{Confirm: confirm.Boolean()}
+	if v, ok := image["email"]; ok && v.DataType() == events.DataTypeString {
+		sub.Email = v.String()
+	}
+	if v, ok := image["id"]; ok && v.DataType() == events.DataTypeString {
+		sub.ID = v.String()
+	}
+	return sub, true
+}
+
+// logSink writes each event to the log.
+type logSink struct{}
+
+func (logSink) Publish(ctx context.Context, event webhookEvent) error {
+	loggerFrom(ctx).Info("subscriber event", "type", event.Type, "event_id", event.ID, logKeyEmail, event.Data.Email)
+	return nil
+}
+
+// webhookSink sends each event to a URL, signed like the handler's webhooks.
+type webhookSink struct {
+	url string
+}
+
+func (s webhookSink) Publish(ctx context.Context, event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return deliverWebhookWithRetry(ctx, webhookDelivery{URL: s.url, EventID: event.ID, Body: string(body)})
+}
+
+// snsSink publishes each event to an SNS topic, with its type as the "type"
+// message attribute for subscription filter policies.
+type snsSink struct {
+	client   SNSAPI
+	topicARN string
+}
+
+func (s snsSink) Publish(ctx context.Context, event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, "SNS_TIMEOUT", defaultPublishTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "SNS", "Publish")
+	defer span.End()
+	defer observeBackend("Publish", time.Now())
+	_, err = s.client.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(s.topicARN),
+		Message:  aws.String(string(body)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"type": {DataType: aws.String("String"), StringValue: aws.String(event.Type)},
+		},
+	})
+	if err != nil {
+		recordSpanError(span, err)
+	}
+	return err
+}
+
+// eventBridgeSink puts each event on an EventBridge bus, with the source
+// "simple-subscribe" and the event's type as its detail type.
+type eventBridgeSink struct {
+	client EventBridgeAPI
+	bus    string
+}
+
+func (s eventBridgeSink) Publish(ctx context.Context, event webhookEvent) error {
+	detail, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, "EVENTBRIDGE_TIMEOUT", defaultPublishTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "EventBridge", "PutEvents")
+	defer span.End()
+	defer observeBackend("PutEvents", time.Now())
+	out, err := s.client.PutEvents(ctx, &eventbridge.PutEventsInput{
+		Entries: []eventbridgetypes.PutEventsRequestEntry{{
+			EventBusName: aws.String(s.bus),
+			Source:       aws.String("simple-subscribe"),
+			DetailType:   aws.String(event.Type),
+			Detail:       aws.String(string(detail)),
+			Time:         aws.Time(event.CreatedAt),
+		}},
+	})
+	if err == nil && out.FailedEntryCount > 0 {
+		err = fmt.Errorf("could not put event: %s", aws.ToString(out.Entries[0].ErrorMessage))
+	}
+	if err != nil {
+		recordSpanError(span, err)
+	}
+	return err
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	eventbridgetypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type MockSNSClient struct {
+	mock.Mock
+}
+
+func (m *MockSNSClient) Publish(ctx context.Context, input *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*sns.PublishOutput), args.Error(1)
+}
+
+type MockEventBridgeClient struct {
+	mock.Mock
+}
+
+func (m *MockEventBridgeClient) PutEvents(ctx context.Context, input *eventbridge.PutEventsInput, optFns ...func(*eventbridge.Options)) (*eventbridge.PutEventsOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*eventbridge.PutEventsOutput), args.Error(1)
+}
+
+// recordingSink keeps the events it is given, failing for types in fail.
+type recordingSink struct {
+	events []webhookEvent
+	fail   map[string]bool
+}
+
+func (s *recordingSink) Publish(_ context.Context, event webhookEvent) error {
+	if s.fail[event.Type] {
+		return errors.New("sink error")
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+// streamImage builds a stream image for a subscriber.
+func streamImage(email string, id string, confirm bool) map[string]events.DynamoDBAttributeValue {
+	return map[string]events.DynamoDBAttributeValue{
+		"email":     events.NewStringAttribute(email),
+		"id":        events.NewStringAttribute(id),
+		"confirm":   events.NewBooleanAttribute(confirm),
+		"timestamp": events.NewStringAttribute("2024-01-01 00:00:00"),
+	}
+}
+
+func streamRecord(name string, seq string, oldImage, newImage map[string]events.DynamoDBAttributeValue) events.DynamoDBEventRecord {
+	return events.DynamoDBEventRecord{
+		EventID:     "evt-" + seq,
+		EventName:   name,
+		EventSource: "aws:dynamodb",
+		Change: events.DynamoDBStreamRecord{
+			ApproximateCreationDateTime: events.SecondsEpochTime{Time: time.Unix(1717200000, 0)},
+			SequenceNumber:              seq,
+			OldImage:                    oldImage,
+			NewImage:                    newImage,
+		},
+	}
+}
+
+func TestSubscriberEventFromRecord(t *testing.T) {
+	tests := []struct {
+		name     string
+		record   events.DynamoDBEventRecord
+		wantType string
+	}{
+		{"Subscribe", streamRecord("INSERT", "1", nil, streamImage("a@example.com", "1", false)), webhookSubscriberPending},
+		{"Added as confirmed", streamRecord("INSERT", "1", nil, streamImage("a@example.com", "1", true)), webhookSubscriberConfirmed},
+		{"Verify", streamRecord("MODIFY", "1", streamImage("a@example.com", "1", false), streamImage("a@example.com", "1", true)), webhookSubscriberConfirmed},
+		{"Subscribe again while pending", streamRecord("MODIFY", "1", streamImage("a@example.com", "1", false), streamImage("a@example.com", "2", false)), streamSubscriberTokenRotated},
+		{"Subscribe again while confirmed", streamRecord("MODIFY", "1", streamImage("a@example.com", "1", true), streamImage("a@example.com", "2", false)), webhookSubscriberPending},
+		{"Timestamp only", streamRecord("MODIFY", "1", streamImage("a@example.com", "1", false), streamImage("a@example.com", "1", false)), ""},
+		{"Unsubscribe", streamRecord("REMOVE", "1", streamImage("a@example.com", "1", true), nil), webhookSubscriberUnsubscribed},
+		{"Pending expired", streamRecord("REMOVE", "1", streamImage("a@example.com", "1", false), nil), streamSubscriberExpired},
+		{"Not a subscriber", streamRecord("INSERT", "1", nil, map[string]events.DynamoDBAttributeValue{
+			"email": events.NewStringAttribute("outbox#1"),
+			"url":   events.NewStringAttribute("https://example.com"),
+		}), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, ok := subscriberEventFromRecord(tt.record)
+			if tt.wantType == "" {
+				assert.False(t, ok)
+				return
+			}
+			assert.True(t, ok)
+			assert.Equal(t, webhookEvent{
+				ID:        "evt-1",
+				Type:      tt.wantType,
+				CreatedAt: time.Unix(1717200000, 0).UTC(),
+				Data:      webhookEventData{Email: "a@example.com"},
+			}, event)
+		})
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+		streamRecord("INSERT", "100", nil, streamImage("a@example.com", "1", false)),
+		streamRecord("REMOVE", "200", streamImage("b@example.com", "2", true), nil),
+		streamRecord("INSERT", "300", nil, streamImage("c@example.com", "3", false)),
+	}}
+
+	t.Run("All records published", func(t *testing.T) {
+		sink := &recordingSink{}
+		resp, err := streamHandler(context.Background(), []eventSink{sink}, event)
+
+		assert.NoError(t, err)
+		assert.Empty(t, resp.BatchItemFailures)
+		assert.Len(t, sink.events, 3)
+	})
+
+	t.Run("Stops at the first failure", func(t *testing.T) {
+		sink := &recordingSink{fail: map[string]bool{webhookSubscriberUnsubscribed: true}}
+		resp, err := streamHandler(context.Background(), []eventSink{sink}, event)
+
+		assert.NoError(t, err)
+		assert.Equal(t, []events.DynamoDBBatchItemFailure{{ItemIdentifier: "200"}}, resp.BatchItemFailures)
+		assert.Len(t, sink.events, 1)
+	})
+}
+
+func TestHandleEventRoutesStreamRecords(t *testing.T) {
+	sink := &recordingSink{}
+	eventSinks = []eventSink{sink}
+	defer func() { eventSinks = nil }()
+
+	payload, err := json.Marshal(events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+		streamRecord("INSERT", "100", nil, streamImage("a@example.com", "1", false)),
+	}})
+	assert.NoError(t, err)
+
+	result, err := handleEvent(context.Background(), &ServiceClients{}, payload)
+
+	assert.NoError(t, err)
+	assert.Equal(t, events.DynamoDBEventResponse{}, result)
+	assert.Len(t, sink.events, 1)
+}
+
+func TestSNSSink(t *testing.T) {
+	mockSNS := new(MockSNSClient)
+	mockSNS.On("Publish", mock.Anything, mock.MatchedBy(func(in *sns.PublishInput) bool {
+		return *in.TopicArn == "arn:aws:sns:us-east-1:123456789012:subscribers" &&
+			*in.MessageAttributes["type"].StringValue == webhookSubscriberConfirmed
+	})).Return(&sns.PublishOutput{}, nil).Once()
+
+	err := snsSink{client: mockSNS, topicARN: "arn:aws:sns:us-east-1:123456789012:subscribers"}.Publish(context.Background(), webhookEvent{Type: webhookSubscriberConfirmed})
+
+	assert.NoError(t, err)
+	mockSNS.AssertExpectations(t)
+}
+
+func TestEventBridgeSink(t *testing.T) {
+	mockEventBridge := new(MockEventBridgeClient)
+	mockEventBridge.On("PutEvents", mock.Anything, mock.MatchedBy(func(in *eventbridge.PutEventsInput) bool {
+		return *in.Entries[0].DetailType == webhookSubscriberConfirmed && *in.Entries[0].Source == "simple-subscribe"
+	})).Return(&eventbridge.PutEventsOutput{}, nil).Once()
+	mockEventBridge.On("PutEvents", mock.Anything, mock.Anything).Return(&eventbridge.PutEventsOutput{
+		FailedEntryCount: 1,
+		Entries:          []eventbridgetypes.PutEventsResultEntry{{ErrorMessage: aws.String("throttled")}},
+	}, nil).Once()
+	sink := eventBridgeSink{client: mockEventBridge, bus: "default"}
+
+	assert.NoError(t, sink.Publish(context.Background(), webhookEvent{Type: webhookSubscriberConfirmed}))
+	assert.ErrorContains(t, sink.Publish(context.Background(), webhookEvent{Type: webhookSubscriberConfirmed}), "throttled")
+	mockEventBridge.AssertExpectations(t)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// subscriber is one item in the table.
+type subscriber struct {
+	Email   string `dynamodbav:"email" json:"email"`
+	ID      string `dynamodbav:"id" json:"id"`
+	Confirm bool   `dynamodbav:"confirm" json:"confirm"`
+	// When the address first asked to subscribe, when it first confirmed, and
+	// when its item last changed, in RFC 3339 format and UTC.
+	CreatedAt   string `dynamodbav:"created_at,omitempty" json:"created_at,omitempty"`
+	ConfirmedAt string `dynamodbav:"confirmed_at,omitempty" json:"confirmed_at,omitempty"`
+	UpdatedAt   string `dynamodbav:"updated_at,omitempty" json:"updated_at,omitempty"`
+	// The single time items had before the attributes above, in timestampLayout.
+	// The migrate-timestamps command replaces it.
+	Timestamp string `dynamodbav:"timestamp,omitempty" json:"-"`
+	ExpiresAt int64  `dynamodbav:"expires_at,omitempty" json:"expires_at,omitempty"`
+	// Custom fields given at signup, allowed by SUBSCRIBER_FIELDS.
+	Fields map[string]string `dynamodbav:"fields,omitempty" json:"fields,omitempty"`
+	// Evidence of consent from the subscribe and verify requests.
+	SubscribeConsent *consentRecord `dynamodbav:"subscribe_consent,omitempty" json:"subscribe_consent,omitempty"`
+	VerifyConsent    *consentRecord `dynamodbav:"verify_consent,omitempty" json:"verify_consent,omitempty"`
+	// How many times the confirmation email was sent again, and when last.
+	ResendCount int    `dynamodbav:"resend_count,omitempty" json:"resend_count,omitempty"`
+	ResentAt    string `dynamodbav:"resent_at,omitempty" json:"resent_at,omitempty"`
+}
+
+// Report whether a pending subscriber's expires_at TTL is at or before now.
+// Subscribers without one, like those who have confirmed, never expire.
+func (s subscriber) expired(now time.Time) bool {
+	return s.ExpiresAt != 0 && s.ExpiresAt <= now.Unix()
+}
+
+// Fill in the times of an item saved before created_at and the others existed,
+// from its legacy timestamp: when it last asked to subscribe or, once
+// confirmed, when it confirmed. Reports whether there was a timestamp to use.
+func (s *subscriber) fillLegacyTimes() bool {
+	if s.Timestamp == "" || s.CreatedAt != "" {
+		return false
+	}
+	t, err := time.ParseInLocation(timestampLayout, s.Timestamp, time.UTC)
+	if err != nil {
+		return false
+	}
+	s.CreatedAt = formatTime(t)
+	s.UpdatedAt = s.CreatedAt
+	if s.Confirm {
+		s.ConfirmedAt = s.CreatedAt
+	}
+	return true
+}
+
+// Describe a subscriber's state as "confirmed" or "pending".
+func (s subscriber) status() string {
+	if s.Confirm {
+		return "confirmed"
+	}
+	return "pending"
+}
+
+// Get the item for an email, or nil if there is none.
+func getSubscriber(ctx context.Context, svc DynamoDBAPI, email string) (*subscriber, error) {
+	item, err := getSubscriberItem(ctx, svc, email)
+	if err != nil || item == nil {
+		return nil, err
+	}
+
+	var sub subscriber
+	if err := attributevalue.UnmarshalMap(item, &sub); err != nil {
+		return nil, err
+	}
+	sub.fillLegacyTimes()
+	return &sub, nil
+}
+
+// Get every attribute stored for an email, or nil if there is no item.
+func getSubscriberItem(ctx context.Context, svc DynamoDBAPI, email string) (map[string]dynamodbtypes.AttributeValue, error) {
+	input := &dynamodb.GetItemInput{
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"email": &dynamodbtypes.AttributeValueMemberS{Value: email},
+		},
+		TableName: aws.String(os.Getenv("DB_TABLE_NAME")),
+	}
+
+	ctx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "DynamoDB", "GetItem")
+	defer span.End()
+	defer observeBackend("GetItem", time.Now())
+	result, err := svc.GetItem(ctx, input)
+	if err != nil {
+		recordSpanError(span, err)
+		loggerFrom(ctx).Error("could not get item", "error", err)
+		return nil, err
+	}
+	return result.Item, nil
+}
+
+// Call fn for each subscriber in the table, a page at a time. A non-empty
+// filter expression (with its names and values) is applied by DynamoDB.
+// Stops at the first error from the scan or from fn.
+func scanSubscribers(ctx context.Context, svc DynamoDBAPI, filter string, names map[string]string, values map[string]dynamodbtypes.AttributeValue, fn func(subscriber) error) error {
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(os.Getenv("DB_TABLE_NAME")),
+	}
+	if filter != "" {
+		input.FilterExpression = aws.String(filter)
+		input.ExpressionAttributeNames = names
+		input.ExpressionAttributeValues = values
+	}
+
+	paginator := dynamodb.NewScanPaginator(svc, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			loggerFrom(ctx).Error("could not scan table", "error", err)
+			return err
+		}
+		for _, item := range page.Items {
+			var sub subscriber
+			if err := attributevalue.UnmarshalMap(item, &sub); err != nil {
+				return err
+			}
+			sub.fillLegacyTimes()
+			if err := fn(sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Scan only subscribers with the given confirm value.
+func scanSubscribersByConfirm(ctx context.Context, svc DynamoDBAPI, confirm bool, fn func(subscriber) error) error {
+	return scanSubscribers(ctx, svc, "#C = :confirmval",
+		map[string]string{"#C": "confirm"},
+		map[string]dynamodbtypes.AttributeValue{
+			":confirmval": &dynamodbtypes.AttributeValueMemberBOOL{Value: confirm},
+		},
+		fn,
+	)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func subscriberItem(email string, id string, confirm bool, timestamp string) map[string]dynamodbtypes.AttributeValue {
+	return map[string]dynamodbtypes.AttributeValue{
+		"email":     &dynamodbtypes.AttributeValueMemberS{Value: email},
+		"id":        &dynamodbtypes.AttributeValueMemberS{Value: id},
+		"confirm":   &dynamodbtypes.AttributeValueMemberBOOL{Value: confirm},
+		"timestamp": &dynamodbtypes.AttributeValueMemberS{Value: timestamp},
+	}
+}
+
+func TestSubscriberExpired(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	assert.False(t, subscriber{}.expired(now))
+	assert.True(t, subscriber{ExpiresAt: 1700000000}.expired(now))
+	assert.False(t, subscriber{ExpiresAt: 1700000001}.expired(now))
+}
+
+func TestFillLegacyTimes(t *testing.T) {
+	tests := []struct {
+		name     string
+		sub      subscriber
+		expected subscriber
+		filled   bool
+	}{
+		{
+			name:     "Pending",
+			sub:      subscriber{Timestamp: "2024-01-01 12:30:00"},
+			expected: subscriber{Timestamp: "2024-01-01 12:30:00", CreatedAt: "2024-01-01T12:30:00Z", UpdatedAt: "2024-01-01T12:30:00Z"},
+			filled:   true,
+		},
+		{
+			name: "Confirmed",
+			sub:  subscriber{Confirm: true, Timestamp: "2024-01-01 12:30:00"},
+			expected: subscriber{Confirm: true, Timestamp: "2024-01-01 12:30:00",
+				CreatedAt: "2024-01-01T12:30:00Z", ConfirmedAt: "2024-01-01T12:30:00Z", UpdatedAt: "2024-01-01T12:30:00Z"},
+			filled: true,
+		},
+		{
+			name:     "Already has times",
+			sub:      subscriber{CreatedAt: "2024-01-01T00:00:00Z", UpdatedAt: "2024-01-02T00:00:00Z"},
+			expected: subscriber{CreatedAt: "2024-01-01T00:00:00Z", UpdatedAt: "2024-01-02T00:00:00Z"},
+		},
+		{
+			name:     "Unreadable",
+			sub:      subscriber{Timestamp: "yesterday"},
+			expected: subscriber{Timestamp: "yesterday"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.filled, tt.sub.fillLegacyTimes())
+			assert.Equal(t, tt.expected, tt.sub)
+		})
+	}
+}
+
+func TestGetSubscriber(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+
+	mockSvc := new(MockDynamoDBClient)
+	mockSvc.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{
+		Item: subscriberItem("test@example.com", "123", true, "2024-01-01 00:00:00"),
+	}, nil).Once()
+	mockSvc.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{}, nil).Once()
+
+	sub, err := getSubscriber(context.Background(), mockSvc, "test@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, &subscriber{
+		Email: "test@example.com", ID: "123", Confirm: true, Timestamp: "2024-01-01 00:00:00",
+		CreatedAt: "2024-01-01T00:00:00Z", ConfirmedAt: "2024-01-01T00:00:00Z", UpdatedAt: "2024-01-01T00:00:00Z",
+	}, sub)
+
+	sub, err = getSubscriber(context.Background(), mockSvc, "missing@example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, sub)
+	mockSvc.AssertExpectations(t)
+}
+
+func TestScanSubscribersByConfirm(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+
+	mockSvc := new(MockDynamoDBClient)
+	mockSvc.On("Scan", mock.Anything, mock.MatchedBy(func(in *dynamodb.ScanInput) bool {
+		v, ok := in.ExpressionAttributeValues[":confirmval"].(*dynamodbtypes.AttributeValueMemberBOOL)
+		return *in.FilterExpression == "#C = :confirmval" && ok && v.Value
+	})).Return(&dynamodb.ScanOutput{
+		Items: []map[string]dynamodbtypes.AttributeValue{
+			subscriberItem("a@example.com", "1", true, "2024-01-01 00:00:00"),
+			subscriberItem("b@example.com", "2", true, "2024-01-02 00:00:00"),
+		},
+	}, nil).Once()
+
+	var emails []string
+	err := scanSubscribersByConfirm(context.Background(), mockSvc, true, func(sub subscriber) error {
+		emails = append(emails, sub.Email)
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a@example.com", "b@example.com"}, emails)
+	mockSvc.AssertExpectations(t)
+}
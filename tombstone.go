@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Tombstones share the subscriber table, keyed by this prefix and a salted
+// hash of the address, so an opt-out is kept without keeping the address.
+const tombstoneKeyPrefix = "tombstone#"
+
+// Layout of the opt-out date on a tombstone.
+const tombstoneDateLayout = "2006-01-02"
+
+// Check that TOMBSTONE_SALT is set. Opt-outs are always recorded and are
+// keyed by it, so Simple Subscribe won't start without one.
+func requireTombstoneSalt() error {
+	if os.Getenv("TOMBSTONE_SALT") == "" {
+		return errors.New("TOMBSTONE_SALT must be set to a long random secret, to record opt-outs")
+	}
+	return nil
+}
+
+// Report whether someone who opted out can subscribe again with the sign up
+// form, set by ALLOW_RESUBSCRIBE_AFTER_OPT_OUT. Their opt-out is cleared when
+// they confirm.
+func resubscribeAfterOptOut() bool {
+	allowed, _ := strconv.ParseBool(os.Getenv("ALLOW_RESUBSCRIBE_AFTER_OPT_OUT"))
+	return allowed
+}
+
+// Hash an address for records that outlive the subscriber, like tombstones and
+// history. The hash is keyed by TOMBSTONE_SALT so the records can't be checked
+// against a list of known addresses.
+func saltedEmailHash(email string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("TOMBSTONE_SALT")))
+	mac.Write([]byte(strings.ToLower(email)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Build the tombstone key for an address.
+func tombstoneKey(email string) string {
+	return tombstoneKeyPrefix + saltedEmailHash(email)
+}
+
+// Build the tombstone recording that an address opted out on now's date.
+func tombstoneItem(email string, now time.Time) map[string]dynamodbtypes.AttributeValue {
+	return map[string]dynamodbtypes.AttributeValue{
+		"email":     &dynamodbtypes.AttributeValueMemberS{Value: tombstoneKey(email)},
+		"opted_out": &dynamodbtypes.AttributeValueMemberS{Value: now.UTC().Format(tombstoneDateLayout)},
+	}
+}
+
+// Report whether an address has opted out.
+func hasTombstone(ctx context.Context, svc DynamoDBAPI, email string) (bool, error) {
+	item, err := getSubscriberItem(ctx, svc, tombstoneKey(email))
+	return item != nil, err
+}
+
+// Report which of up to 100 addresses have opted out.
+func optedOutEmails(ctx context.Context, svc DynamoDBAPI, emails []string) (map[string]bool, error) {
+	optedOut := make(map[string]bool)
+	if len(emails) == 0 {
+		return optedOut, nil
+	}
+	keys := make([]string, len(emails))
+	for i, email := range emails {
+		keys[i] = tombstoneKey(email)
+	}
+	found, err := existingEmails(ctx, svc, keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		if found[key] {
+			optedOut[emails[i]] = true
+		}
+	}
+	return optedOut, nil
+}
+
+// Remove an address's tombstone, for when they rejoin the list. Reports
+// whether there was one.
+func deleteTombstone(ctx context.Context, svc DynamoDBAPI, email string) (bool, error) {
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(os.Getenv("DB_TABLE_NAME")),
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"email": &dynamodbtypes.AttributeValueMemberS{Value: tombstoneKey(email)},
+		},
+		ReturnValues: dynamodbtypes.ReturnValueAllOld,
+	}
+
+	ctx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "DynamoDB", "DeleteItem")
+	defer span.End()
+	defer observeBackend("DeleteItem", time.Now())
+	result, err := svc.DeleteItem(ctx, input)
+	if err != nil {
+		recordSpanError(span, err)
+		loggerFrom(ctx).Error("could not delete tombstone", "error", err)
+		return false, err
+	}
+	return len(result.Attributes) > 0, nil
+}
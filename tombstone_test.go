@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// Match a DynamoDB key that is the tombstone for an address.
+func tombstoneKeyFor(email string) func(map[string]dynamodbtypes.AttributeValue) bool {
+	return func(key map[string]dynamodbtypes.AttributeValue) bool {
+		v, ok := key["email"].(*dynamodbtypes.AttributeValueMemberS)
+		return ok && v.Value == tombstoneKey(email)
+	}
+}
+
+// Expect a check for an address's opt-out that finds none.
+func expectNoTombstone(db *MockDynamoDBClient, email string) {
+	db.On("GetItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return tombstoneKeyFor(email)(in.Key)
+	})).Return(&dynamodb.GetItemOutput{}, nil).Once()
+}
+
+func TestTombstoneKey(t *testing.T) {
+	os.Setenv("TOMBSTONE_SALT", "pepper")
+	defer os.Unsetenv("TOMBSTONE_SALT")
+
+	key := tombstoneKey("Ford@Example.com")
+	assert.True(t, strings.HasPrefix(key, tombstoneKeyPrefix))
+	assert.NotContains(t, key, "ford")
+	assert.Equal(t, key, tombstoneKey("ford@example.com"))
+
+	os.Setenv("TOMBSTONE_SALT", "salt")
+	assert.NotEqual(t, key, tombstoneKey("ford@example.com"))
+}
+
+func TestDeleteEmailLeavesTombstone(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	os.Setenv("TOMBSTONE_SALT", "pepper")
+	defer os.Unsetenv("TOMBSTONE_SALT")
+
+	// The delete and the tombstone are one transaction, so neither happens
+	// without the other.
+	mockSvc := new(MockDynamoDBClient)
+	mockSvc.On("TransactWriteItems", mock.Anything, mock.MatchedBy(func(in *dynamodb.TransactWriteItemsInput) bool {
+		if len(in.TransactItems) != 2 {
+			return false
+		}
+		del, put := in.TransactItems[0].Delete, in.TransactItems[1].Put
+		date := put.Item["opted_out"].(*dynamodbtypes.AttributeValueMemberS)
+		return del.Key["email"].(*dynamodbtypes.AttributeValueMemberS).Value == "test@example.com" &&
+			*del.ConditionExpression == "email = :emailval AND id = :idval" &&
+			tombstoneKeyFor("test@example.com")(put.Item) &&
+			date.Value == time.Now().UTC().Format(tombstoneDateLayout) &&
+			len(put.Item) == 2
+	})).Return(&dynamodb.TransactWriteItemsOutput{}, nil).Once()
+
+	_, err := deleteEmailFromDynamoDb(context.Background(), mockSvc, "test@example.com", "123")
+
+	assert.NoError(t, err)
+	mockSvc.AssertExpectations(t)
+}
+
+func TestFailedDeleteLeavesNoTombstone(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	os.Setenv("TOMBSTONE_SALT", "pepper")
+	defer os.Unsetenv("TOMBSTONE_SALT")
+
+	// A failed transaction writes nothing, and nothing else is tried.
+	mockSvc := new(MockDynamoDBClient)
+	mockSvc.On("TransactWriteItems", mock.Anything, mock.AnythingOfType("*dynamodb.TransactWriteItemsInput")).Return(&dynamodb.TransactWriteItemsOutput{}, errors.New("delete error")).Once()
+
+	_, err := deleteEmailFromDynamoDb(context.Background(), mockSvc, "test@example.com", "123")
+
+	assert.ErrorContains(t, err, "delete error")
+	mockSvc.AssertExpectations(t)
+}
+
+func TestSubscribeHonorsOptOut(t *testing.T) {
+	os.Setenv("BASE_URL", "https://example.com")
+	os.Setenv("CONFIRM_SUBSCRIBE_PAGE", "/confirm-subscribe")
+	os.Setenv("SUBSCRIBE_PATH", "subscribe")
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	os.Setenv("TOMBSTONE_SALT", "pepper")
+	defer os.Unsetenv("TOMBSTONE_SALT")
+	request := events.APIGatewayV2HTTPRequest{
+		RawPath:               "/subscribe/",
+		QueryStringParameters: map[string]string{"email": "gone@example.com"},
+	}
+
+	t.Run("Opted out addresses are ignored", func(t *testing.T) {
+		mockDynamoDB := new(MockDynamoDBClient)
+		mockSES := new(MockSESClient)
+		mockDynamoDB.On("GetItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+			return in.Key["email"].(*dynamodbtypes.AttributeValueMemberS).Value == "gone@example.com"
+		})).Return(&dynamodb.GetItemOutput{}, nil).Once()
+		mockDynamoDB.On("GetItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+			return tombstoneKeyFor("gone@example.com")(in.Key)
+		})).Return(&dynamodb.GetItemOutput{Item: map[string]dynamodbtypes.AttributeValue{
+			"email":     &dynamodbtypes.AttributeValueMemberS{Value: tombstoneKey("gone@example.com")},
+			"opted_out": &dynamodbtypes.AttributeValueMemberS{Value: "2024-06-01"},
+		}}, nil).Once()
+
+		resp, err := lambdaHandler(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB, SES: mockSES}, request)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "https://example.com/confirm-subscribe", resp.Headers["Location"])
+		mockDynamoDB.AssertExpectations(t)
+		mockSES.AssertNotCalled(t, "SendEmail", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Opted out addresses can sign up again when allowed", func(t *testing.T) {
+		os.Setenv("ALLOW_RESUBSCRIBE_AFTER_OPT_OUT", "true")
+		defer os.Unsetenv("ALLOW_RESUBSCRIBE_AFTER_OPT_OUT")
+		mockDynamoDB := new(MockDynamoDBClient)
+		mockSES := new(MockSESClient)
+		mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{}, nil).Once()
+		mockDynamoDB.On("UpdateItem", mock.Anything, mock.AnythingOfType("*dynamodb.UpdateItemInput")).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+		mockSES.On("SendEmail", mock.Anything, mock.AnythingOfType("*ses.SendEmailInput")).Return(&ses.SendEmailOutput{}, nil).Once()
+
+		resp, err := lambdaHandler(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB, SES: mockSES}, request)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "https://example.com/confirm-subscribe", resp.Headers["Location"])
+		mockDynamoDB.AssertExpectations(t)
+		mockSES.AssertExpectations(t)
+	})
+}
+
+func TestConfirmClearsOptOut(t *testing.T) {
+	os.Setenv("VERIFY_PATH", "verify")
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	os.Setenv("HISTORY_TABLE_NAME", "History")
+	defer os.Unsetenv("HISTORY_TABLE_NAME")
+	os.Setenv("TOMBSTONE_SALT", "pepper")
+	defer os.Unsetenv("TOMBSTONE_SALT")
+
+	// Someone who opted out subscribed again, and now confirms.
+	mockDynamoDB := new(MockDynamoDBClient)
+	mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{
+		Item: subscriberItem("back@example.com", "1", false, "2024-06-01 11:00:00"),
+	}, nil).Once()
+	mockDynamoDB.On("UpdateItem", mock.Anything, mock.AnythingOfType("*dynamodb.UpdateItemInput")).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+	mockDynamoDB.On("DeleteItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.DeleteItemInput) bool {
+		return tombstoneKeyFor("back@example.com")(in.Key)
+	})).Return(&dynamodb.DeleteItemOutput{Attributes: map[string]dynamodbtypes.AttributeValue{
+		"email":     &dynamodbtypes.AttributeValueMemberS{Value: tombstoneKey("back@example.com")},
+		"opted_out": &dynamodbtypes.AttributeValueMemberS{Value: "2024-01-01"},
+	}}, nil).Once()
+	mockDynamoDB.On("PutItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.PutItemInput) bool {
+		return in.Item["action"].(*dynamodbtypes.AttributeValueMemberS).Value == historyConfirmed
+	})).Return(&dynamodb.PutItemOutput{}, nil).Once()
+	mockDynamoDB.On("PutItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.PutItemInput) bool {
+		return in.Item["action"].(*dynamodbtypes.AttributeValueMemberS).Value == historyOptOutCleared &&
+			in.Item["actor"].(*dynamodbtypes.AttributeValueMemberS).Value == historyActorSelf
+	})).Return(&dynamodb.PutItemOutput{}, nil).Once()
+
+	_, err := lambdaHandler(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB}, events.APIGatewayV2HTTPRequest{
+		RawPath:               "/verify/",
+		QueryStringParameters: map[string]string{"email": "back@example.com", "id": "1"},
+	})
+
+	assert.NoError(t, err)
+	mockDynamoDB.AssertExpectations(t)
+}
+
+func TestImportSkipsOptedOutAddresses(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	os.Setenv("TOMBSTONE_SALT", "pepper")
+	defer os.Unsetenv("TOMBSTONE_SALT")
+
+	db := new(MockDynamoDBClient)
+	db.On("BatchGetItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.BatchGetItemInput) bool {
+		return tombstoneKeyFor("a@example.com")(in.RequestItems["TestTable"].Keys[0])
+	})).Return(&dynamodb.BatchGetItemOutput{
+		Responses: map[string][]map[string]dynamodbtypes.AttributeValue{
+			"TestTable": {{"email": &dynamodbtypes.AttributeValueMemberS{Value: tombstoneKey("a@example.com")}}},
+		},
+	}, nil).Once()
+	db.On("BatchGetItem", mock.Anything, mock.AnythingOfType("*dynamodb.BatchGetItemInput")).Return(&dynamodb.BatchGetItemOutput{}, nil).Once()
+	db.On("BatchWriteItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.BatchWriteItemInput) bool {
+		requests := in.RequestItems["TestTable"]
+		return len(requests) == 1 &&
+			requests[0].PutRequest.Item["email"].(*dynamodbtypes.AttributeValueMemberS).Value == "b@example.com"
+	})).Return(&dynamodb.BatchWriteItemOutput{}, nil).Once()
+
+	report, err := importSubscribers(context.Background(), &ServiceClients{DynamoDB: db}, []string{"a@example.com", "b@example.com"}, importOptions{Confirmed: true, Rate: 1})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.OptedOut)
+	assert.Equal(t, 1, report.Imported)
+	db.AssertExpectations(t)
+}
+
+func TestAdminClearOptOut(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	os.Setenv("TOMBSTONE_SALT", "pepper")
+	defer os.Unsetenv("TOMBSTONE_SALT")
+
+	db := new(MockDynamoDBClient)
+	db.On("GetItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.GetItemInput) bool {
+		return tombstoneKeyFor("gone@example.com")(in.Key)
+	})).Return(&dynamodb.GetItemOutput{Item: map[string]dynamodbtypes.AttributeValue{
+		"email": &dynamodbtypes.AttributeValueMemberS{Value: tombstoneKey("gone@example.com")},
+	}}, nil).Once()
+	db.On("DeleteItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.DeleteItemInput) bool {
+		return tombstoneKeyFor("gone@example.com")(in.Key)
+	})).Return(&dynamodb.DeleteItemOutput{}, nil).Once()
+
+	var out bytes.Buffer
+	err := runAdmin(context.Background(), &ServiceClients{DynamoDB: db}, []string{"clear-opt-out", "gone@example.com"}, &out)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "cleared opt-out for gone@example.com\n", out.String())
+	db.AssertExpectations(t)
+}
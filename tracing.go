@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/victoriadrake/simple-subscribe"
+
+// tracerProvider is set when tracing is enabled, so spans can be flushed
+// before a Lambda invocation is frozen.
+var tracerProvider *sdktrace.TracerProvider
+
+// Configure tracing according to OTEL_TRACES_EXPORTER: "stdout", "otlp", or
+// "none" (the default). The OTLP exporter reads the standard
+// OTEL_EXPORTER_OTLP_* environment variables for its endpoint and headers.
+func setupTracing(ctx context.Context) error {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch os.Getenv("OTEL_TRACES_EXPORTER") {
+	case "", "none":
+		return nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	default:
+		return fmt.Errorf("unknown OTEL_TRACES_EXPORTER: %s", os.Getenv("OTEL_TRACES_EXPORTER"))
+	}
+	if err != nil {
+		return err
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName(envOrDefault("OTEL_SERVICE_NAME", "simple-subscribe")),
+		)),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	return nil
+}
+
+// Export any buffered spans. Lambda may freeze the process between invocations.
+func flushTraces(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.ForceFlush(ctx); err != nil {
+		logger.Warn("could not flush traces", "error", err)
+	}
+}
+
+// Start a span using the global tracer provider, which does nothing unless
+// tracing has been set up.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Start a client span for a call to an AWS service.
+func startBackendSpan(ctx context.Context, service string, operation string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, service+"."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "aws-api"),
+			attribute.String("rpc.service", service),
+			attribute.String("rpc.method", operation),
+		),
+	)
+}
+
+// Mark a span as failed. Errors from AWS do not include the request's email or id.
+func recordSpanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSetupTracingUnknownExporter(t *testing.T) {
+	os.Setenv("OTEL_TRACES_EXPORTER", "carrier-pigeon")
+	defer os.Unsetenv("OTEL_TRACES_EXPORTER")
+
+	assert.Error(t, setupTracing(context.Background()))
+}
+
+func TestLambdaHandlerSpans(t *testing.T) {
+	os.Setenv("VERIFY_PATH", "verify")
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	mockDynamoDB := new(MockDynamoDBClient)
+	mockDynamoDB.On("GetItem", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).Return(&dynamodb.GetItemOutput{
+		Item: map[string]dynamodbtypes.AttributeValue{
+			"email": &dynamodbtypes.AttributeValueMemberS{Value: "traced@example.com"},
+			"id":    &dynamodbtypes.AttributeValueMemberS{Value: "traced-id"},
+		},
+	}, nil).Once()
+	mockDynamoDB.On("UpdateItem", mock.Anything, mock.AnythingOfType("*dynamodb.UpdateItemInput")).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+	mockDynamoDB.On("DeleteItem", mock.Anything, mock.AnythingOfType("*dynamodb.DeleteItemInput")).Return(&dynamodb.DeleteItemOutput{}, nil).Once()
+
+	_, err := lambdaHandler(context.Background(), &ServiceClients{DynamoDB: mockDynamoDB}, events.APIGatewayV2HTTPRequest{
+		RawPath:        "/verify/",
+		RawQueryString: "email=traced@example.com&id=traced-id",
+		QueryStringParameters: map[string]string{
+			"email": "traced@example.com",
+			"id":    "traced-id",
+		},
+	})
+	assert.NoError(t, err)
+
+	spans := exporter.GetSpans()
+	names := make(map[string]tracetest.SpanStub)
+	for _, s := range spans {
+		names[s.Name] = s
+	}
+	assert.Len(t, spans, 4)
+	root, ok := names["lambdaHandler"]
+	assert.True(t, ok)
+	for _, child := range []string{"DynamoDB.GetItem", "DynamoDB.UpdateItem", "DynamoDB.DeleteItem"} {
+		assert.Equal(t, root.SpanContext.SpanID(), names[child].Parent.SpanID(), child)
+	}
+
+	// Spans must not carry the subscriber's address or token.
+	for _, s := range spans {
+		for _, attr := range s.Attributes {
+			assert.NotContains(t, attr.Value.Emit(), "traced@example.com")
+			assert.NotContains(t, attr.Value.Emit(), "traced-id")
+		}
+	}
+	mockDynamoDB.AssertExpectations(t)
+}
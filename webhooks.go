@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+// Types of subscriber lifecycle event sent to webhooks.
+const (
+	webhookSubscriberPending      = "subscriber.pending"
+	webhookSubscriberConfirmed    = "subscriber.confirmed"
+	webhookSubscriberUnsubscribed = "subscriber.unsubscribed"
+)
+
+// Deliveries that haven't succeeded yet are kept in the subscriber table under
+// a key that can't be an email address. They have no confirm attribute, so
+// they are never sent mail, and they expire after WEBHOOK_RETENTION.
+const (
+	outboxKeyPrefix         = "outbox#"
+	defaultWebhookRetention = 72 * time.Hour
+	webhookAttempts         = 3
+	maxOutboxBackoff        = 6 * time.Hour
+)
+
+// How long a subscriber's request waits for its webhooks before leaving them
+// to the outbox.
+const defaultWebhookInlineTimeout = time.Second
+
+// Headers set on every webhook request.
+const (
+	webhookIDHeader        = "X-Webhook-Id"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// webhookEvent is the JSON body of a webhook request.
+type webhookEvent struct {
+	ID        string           `json:"id"`
+	Type      string           `json:"type"`
+	CreatedAt time.Time        `json:"created_at"`
+	Data      webhookEventData `json:"data"`
+}
+
+type webhookEventData struct {
+	Email string `json:"email"`
+}
+
+// webhookDelivery is one event waiting to be delivered to one URL.
+type webhookDelivery struct {
+	Key         string `dynamodbav:"email"`
+	URL         string `dynamodbav:"url"`
+	EventID     string `dynamodbav:"event_id"`
+	Body        string `dynamodbav:"body"`
+	Attempts    int    `dynamodbav:"attempts"`
+	NextAttempt int64  `dynamodbav:"next_attempt"`
+	ExpiresAt   int64  `dynamodbav:"expires_at"`
+}
+
+// Return the webhook URLs in WEBHOOK_URLS, a comma-separated list.
+func webhookURLs() []string {
+	var urls []string
+	for _, u := range strings.Split(os.Getenv("WEBHOOK_URLS"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// Send a subscriber lifecycle event to each configured webhook. Each delivery
+// is saved to the outbox and tried once, all at the same time and within
+// WEBHOOK_INLINE_TIMEOUT, so a slow receiver can't hold up the subscriber's
+// request. Deliveries that succeed are removed from the outbox, and the rest
+// are retried by the scheduled "outbox" job. Failures are logged but don't
+// affect the subscriber's request.
+func emitWebhookEvent(ctx context.Context, svc DynamoDBAPI, eventType string, email string) {
+	urls := webhookURLs()
+	if len(urls) == 0 {
+		return
+	}
+	log := loggerFrom(ctx).With("webhook_event", eventType)
+	if os.Getenv("WEBHOOK_SECRET") == "" {
+		log.Error("not sending webhooks because WEBHOOK_SECRET is not set")
+		return
+	}
+
+	now := clock().UTC()
+	event := webhookEvent{
+		ID:        uuid.New().String(),
+		Type:      eventType,
+		CreatedAt: now,
+		Data:      webhookEventData{Email: email},
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Error("could not encode webhook event", "error", err)
+		return
+	}
+
+	retention := defaultWebhookRetention
+	if d, err := time.ParseDuration(os.Getenv("WEBHOOK_RETENTION")); err == nil && d > 0 {
+		retention = d
+	}
+	deliveries := make([]webhookDelivery, len(urls))
+	saveErrs := make([]error, len(urls))
+	for i, url := range urls {
+		deliveries[i] = webhookDelivery{
+			Key:         outboxKeyPrefix + uuid.New().String(),
+			URL:         url,
+			EventID:     event.ID,
+			Body:        string(body),
+			NextAttempt: now.Unix(),
+			ExpiresAt:   now.Add(retention).Unix(),
+		}
+		if saveErrs[i] = saveWebhookDelivery(ctx, svc, deliveries[i]); saveErrs[i] != nil {
+			log.Error("could not save webhook delivery to outbox", "error", saveErrs[i])
+		}
+	}
+
+	errs := deliverWebhooksOnce(ctx, deliveries)
+	for i, d := range deliveries {
+		err, saveErr := errs[i], saveErrs[i]
+		switch {
+		case err == nil && saveErr == nil:
+			if err := deleteWebhookDelivery(ctx, svc, d.Key); err != nil {
+				log.Warn("could not remove delivered webhook from outbox", "error", err)
+			}
+		case err != nil && saveErr != nil:
+			log.Error("could not deliver webhook, and it is not in the outbox", "error", err, "url", d.URL)
+		case err != nil:
+			log.Warn("could not deliver webhook, will retry from outbox", "error", err, "url", d.URL)
+			d.Attempts = 1
+			d.NextAttempt = nextOutboxAttempt(now, d.Attempts).Unix()
+			if err := saveWebhookDelivery(ctx, svc, d); err != nil {
+				log.Warn("could not record webhook attempts", "error", err)
+			}
+		}
+	}
+}
+
+// Try each delivery once, concurrently, giving up on all of them after
+// WEBHOOK_INLINE_TIMEOUT. Returns each delivery's error in order.
+func deliverWebhooksOnce(ctx context.Context, deliveries []webhookDelivery) []error {
+	ctx, cancel := withTimeout(ctx, "WEBHOOK_INLINE_TIMEOUT", defaultWebhookInlineTimeout)
+	defer cancel()
+	errs := make([]error, len(deliveries))
+	var wg sync.WaitGroup
+	for i, d := range deliveries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = deliverWebhook(ctx, d, clock())
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// Try to deliver a webhook a few times, backing off between attempts. Only for
+// callers that aren't answering a subscriber, like the stream sinks.
+func deliverWebhookWithRetry(ctx context.Context, d webhookDelivery) error {
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := deliverWebhook(ctx, d, clock())
+		if err == nil || attempt == webhookAttempts {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Make one signed request for a delivery.
+func deliverWebhook(ctx context.Context, d webhookDelivery, now time.Time) error {
+	ctx, cancel := withTimeout(ctx, "WEBHOOK_TIMEOUT", 3*time.Second)
+	defer cancel()
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	return postBody(ctx, d.URL, []byte(d.Body), map[string]string{
+		webhookIDHeader:        d.EventID,
+		webhookTimestampHeader: timestamp,
+		webhookSignatureHeader: "sha256=" + signWebhook(os.Getenv("WEBHOOK_SECRET"), timestamp, []byte(d.Body)),
+	})
+}
+
+// Sign a webhook body with HMAC-SHA256 over the timestamp, a ".", and the
+// body, so receivers can reject both forged and replayed requests.
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Return when to next try a delivery that has failed attempts times, doubling
+// from one minute up to maxOutboxBackoff.
+func nextOutboxAttempt(now time.Time, attempts int) time.Time {
+	backoff := maxOutboxBackoff
+	if attempts < 20 {
+		backoff = min(time.Minute<<attempts, maxOutboxBackoff)
+	}
+	return now.Add(backoff)
+}
+
+// Retry each delivery in the outbox that is due, removing those that succeed.
+func retryWebhookOutbox(ctx context.Context, svc DynamoDBAPI, now time.Time) (delivered int, failed int, err error) {
+	log := loggerFrom(ctx)
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(os.Getenv("DB_TABLE_NAME")),
+		FilterExpression: aws.String("begins_with(#K, :prefix) AND #N <= :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#K": "email",
+			"#N": "next_attempt",
+		},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":prefix": &dynamodbtypes.AttributeValueMemberS{Value: outboxKeyPrefix},
+			":now":    &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	}
+
+	paginator := dynamodb.NewScanPaginator(svc, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Error("could not scan outbox", "error", err)
+			return delivered, failed, err
+		}
+		for _, item := range page.Items {
+			var d webhookDelivery
+			if err := attributevalue.UnmarshalMap(item, &d); err != nil {
+				return delivered, failed, err
+			}
+			if derr := deliverWebhook(ctx, d, now); derr != nil {
+				failed++
+				d.Attempts++
+				d.NextAttempt = nextOutboxAttempt(now, d.Attempts).Unix()
+				log.Warn("could not deliver webhook from outbox", "error", derr, "url", d.URL, "attempts", d.Attempts)
+				if err := saveWebhookDelivery(ctx, svc, d); err != nil {
+					return delivered, failed, err
+				}
+				continue
+			}
+			delivered++
+			if err := deleteWebhookDelivery(ctx, svc, d.Key); err != nil {
+				return delivered, failed, err
+			}
+		}
+	}
+	return delivered, failed, nil
+}
+
+// Write a delivery to the outbox.
+func saveWebhookDelivery(ctx context.Context, svc DynamoDBAPI, d webhookDelivery) error {
+	item, err := attributevalue.MarshalMap(d)
+	if err != nil {
+		return err
+	}
+	delete(item, "email")
+	names := make(map[string]string, len(item))
+	values := make(map[string]dynamodbtypes.AttributeValue, len(item))
+	var sets []string
+	for name, value := range item {
+		names["#"+name] = name
+		values[":"+name] = value
+		sets = append(sets, "#"+name+" = :"+name)
+	}
+
+	ctx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "DynamoDB", "UpdateItem")
+	defer span.End()
+	defer observeBackend("UpdateItem", time.Now())
+	_, err = svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"email": &dynamodbtypes.AttributeValueMemberS{Value: d.Key},
+		},
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		UpdateExpression:          aws.String("SET " + strings.Join(sets, ", ")),
+		TableName:                 aws.String(os.Getenv("DB_TABLE_NAME")),
+	})
+	if err != nil {
+		recordSpanError(span, err)
+	}
+	return err
+}
+
+// Remove a delivery from the outbox.
+func deleteWebhookDelivery(ctx context.Context, svc DynamoDBAPI, key string) error {
+	if !strings.HasPrefix(key, outboxKeyPrefix) {
+		return errors.New("not an outbox key")
+	}
+	ctx, cancel := withTimeout(ctx, "DB_TIMEOUT", defaultDBTimeout)
+	defer cancel()
+	ctx, span := startBackendSpan(ctx, "DynamoDB", "DeleteItem")
+	defer span.End()
+	defer observeBackend("DeleteItem", time.Now())
+	_, err := svc.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"email": &dynamodbtypes.AttributeValueMemberS{Value: key},
+		},
+		TableName: aws.String(os.Getenv("DB_TABLE_NAME")),
+	})
+	if err != nil {
+		recordSpanError(span, err)
+	}
+	return err
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSignWebhook(t *testing.T) {
+	// echo -n '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	assert.Equal(t, "b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163", signWebhook("secret", "1700000000", []byte("{}")))
+}
+
+func TestNextOutboxAttempt(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, now.Add(2*time.Minute), nextOutboxAttempt(now, 1))
+	assert.Equal(t, now.Add(8*time.Minute), nextOutboxAttempt(now, 3))
+	assert.Equal(t, now.Add(maxOutboxBackoff), nextOutboxAttempt(now, 12))
+	assert.Equal(t, now.Add(maxOutboxBackoff), nextOutboxAttempt(now, 100))
+}
+
+// webhookReceiver records the requests it gets and fails the first failures of them.
+func webhookReceiver(t *testing.T, failures int32) (*httptest.Server, *[]*http.Request, *[][]byte) {
+	var requests []*http.Request
+	var bodies [][]byte
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r)
+		bodies = append(bodies, body)
+		if calls.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests, &bodies
+}
+
+func TestEmitWebhookEvent(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	os.Setenv("WEBHOOK_SECRET", "secret")
+	defer os.Unsetenv("WEBHOOK_SECRET")
+	isOutbox := func(key map[string]dynamodbtypes.AttributeValue) bool {
+		return strings.HasPrefix(key["email"].(*dynamodbtypes.AttributeValueMemberS).Value, outboxKeyPrefix)
+	}
+
+	t.Run("Delivered events are removed from the outbox", func(t *testing.T) {
+		server, requests, bodies := webhookReceiver(t, 0)
+		os.Setenv("WEBHOOK_URLS", server.URL)
+		defer os.Unsetenv("WEBHOOK_URLS")
+
+		mockDynamoDB := new(MockDynamoDBClient)
+		mockDynamoDB.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+			return isOutbox(in.Key)
+		})).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+		mockDynamoDB.On("DeleteItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.DeleteItemInput) bool {
+			return isOutbox(in.Key)
+		})).Return(&dynamodb.DeleteItemOutput{}, nil).Once()
+
+		emitWebhookEvent(context.Background(), mockDynamoDB, webhookSubscriberConfirmed, "test@example.com")
+
+		mockDynamoDB.AssertExpectations(t)
+		assert.Len(t, *requests, 1)
+		last := (*requests)[0]
+		body := (*bodies)[0]
+		var event webhookEvent
+		assert.NoError(t, json.Unmarshal(body, &event))
+		assert.Equal(t, webhookSubscriberConfirmed, event.Type)
+		assert.Equal(t, "test@example.com", event.Data.Email)
+		assert.Equal(t, event.ID, last.Header.Get(webhookIDHeader))
+		assert.Equal(t, "sha256="+signWebhook("secret", last.Header.Get(webhookTimestampHeader), body), last.Header.Get(webhookSignatureHeader))
+	})
+
+	t.Run("Undelivered events stay in the outbox", func(t *testing.T) {
+		server, requests, _ := webhookReceiver(t, 1)
+		os.Setenv("WEBHOOK_URLS", server.URL)
+		defer os.Unsetenv("WEBHOOK_URLS")
+
+		mockDynamoDB := new(MockDynamoDBClient)
+		mockDynamoDB.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+			return isOutbox(in.Key) && in.ExpressionAttributeValues[":attempts"].(*dynamodbtypes.AttributeValueMemberN).Value == "0"
+		})).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+		mockDynamoDB.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+			return isOutbox(in.Key) && in.ExpressionAttributeValues[":attempts"].(*dynamodbtypes.AttributeValueMemberN).Value == "1"
+		})).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+
+		emitWebhookEvent(context.Background(), mockDynamoDB, webhookSubscriberPending, "test@example.com")
+
+		mockDynamoDB.AssertExpectations(t)
+		mockDynamoDB.AssertNotCalled(t, "DeleteItem", mock.Anything, mock.Anything)
+		// Retries are left to the outbox.
+		assert.Len(t, *requests, 1)
+	})
+
+	t.Run("Slow receivers are left to the outbox", func(t *testing.T) {
+		os.Setenv("WEBHOOK_INLINE_TIMEOUT", "50ms")
+		defer os.Unsetenv("WEBHOOK_INLINE_TIMEOUT")
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Second)
+		}))
+		defer slow.Close()
+		os.Setenv("WEBHOOK_URLS", slow.URL+","+slow.URL)
+		defer os.Unsetenv("WEBHOOK_URLS")
+
+		mockDynamoDB := new(MockDynamoDBClient)
+		mockDynamoDB.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+			return isOutbox(in.Key)
+		})).Return(&dynamodb.UpdateItemOutput{}, nil).Times(4)
+
+		start := time.Now()
+		emitWebhookEvent(context.Background(), mockDynamoDB, webhookSubscriberPending, "test@example.com")
+
+		// Both are tried at once, and neither waits for the receiver.
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+		mockDynamoDB.AssertExpectations(t)
+	})
+
+	t.Run("Nothing is sent without a secret", func(t *testing.T) {
+		server, requests, _ := webhookReceiver(t, 0)
+		os.Setenv("WEBHOOK_URLS", server.URL)
+		defer os.Unsetenv("WEBHOOK_URLS")
+		os.Unsetenv("WEBHOOK_SECRET")
+		defer os.Setenv("WEBHOOK_SECRET", "secret")
+
+		emitWebhookEvent(context.Background(), new(MockDynamoDBClient), webhookSubscriberPending, "test@example.com")
+
+		assert.Empty(t, *requests)
+	})
+}
+
+func TestRetryWebhookOutbox(t *testing.T) {
+	os.Setenv("DB_TABLE_NAME", "TestTable")
+	os.Setenv("WEBHOOK_SECRET", "secret")
+	defer os.Unsetenv("WEBHOOK_SECRET")
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	up, upRequests, _ := webhookReceiver(t, 0)
+	down, _, _ := webhookReceiver(t, 100)
+
+	item := func(key string, url string, attempts int) map[string]dynamodbtypes.AttributeValue {
+		av, err := attributevalue.MarshalMap(webhookDelivery{Key: key, URL: url, EventID: "evt", Body: "{}", Attempts: attempts})
+		assert.NoError(t, err)
+		return av
+	}
+	mockDynamoDB := new(MockDynamoDBClient)
+	mockDynamoDB.On("Scan", mock.Anything, mock.MatchedBy(func(in *dynamodb.ScanInput) bool {
+		return *in.FilterExpression == "begins_with(#K, :prefix) AND #N <= :now"
+	})).Return(&dynamodb.ScanOutput{Items: []map[string]dynamodbtypes.AttributeValue{
+		item("outbox#1", up.URL, 3),
+		item("outbox#2", down.URL, 3),
+	}}, nil).Once()
+	mockDynamoDB.On("DeleteItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.DeleteItemInput) bool {
+		return in.Key["email"].(*dynamodbtypes.AttributeValueMemberS).Value == "outbox#1"
+	})).Return(&dynamodb.DeleteItemOutput{}, nil).Once()
+	mockDynamoDB.On("UpdateItem", mock.Anything, mock.MatchedBy(func(in *dynamodb.UpdateItemInput) bool {
+		return in.Key["email"].(*dynamodbtypes.AttributeValueMemberS).Value == "outbox#2" &&
+			in.ExpressionAttributeValues[":attempts"].(*dynamodbtypes.AttributeValueMemberN).Value == "4" &&
+			in.ExpressionAttributeValues[":next_attempt"].(*dynamodbtypes.AttributeValueMemberN).Value == "1717200960"
+	})).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+
+	delivered, failed, err := retryWebhookOutbox(context.Background(), mockDynamoDB, now)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, delivered)
+	assert.Equal(t, 1, failed)
+	assert.Equal(t, "1717200000", (*upRequests)[0].Header.Get(webhookTimestampHeader))
+	mockDynamoDB.AssertExpectations(t)
+}